@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const acmeChallengePrefix = "_acme-challenge."
+
+var acmeValuePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,255}$`)
+
+func acmeChallengeName(domain string) string {
+	return acmeChallengePrefix + domain
+}
+
+func normalizeACMEDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	domain = strings.TrimPrefix(domain, acmeChallengePrefix)
+	domain = strings.TrimPrefix(domain, "*.")
+	return domain
+}
+
+func handleACMEPresent(config *ServerConfig, zones *zoneRegistry) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		payload, status, err := verifySignedRequest(ctx.PostBody(), "acme-present")
+		if err != nil {
+			writeJSONError(ctx, status, err.Error())
+			return
+		}
+
+		if !acmeValuePattern.MatchString(payload.Value) {
+			writeJSONError(ctx, fasthttp.StatusBadRequest, "Invalid challenge value")
+			return
+		}
+
+		provider, err := zones.lookup(payload.Domain)
+		if err != nil {
+			fmt.Printf("Error finding zone for %s: %v\n", payload.Domain, err)
+			writeJSONError(ctx, fasthttp.StatusInternalServerError, "No DNS zone configured for domain")
+			return
+		}
+
+		name := acmeChallengeName(payload.Domain)
+		err = withRetry(config.Retry, "ACME present for "+payload.Domain, func() error {
+			return provider.AddRecord(name, "TXT", payload.Value)
+		})
+		if err != nil {
+			fmt.Printf("Error creating ACME challenge for %s: %v\n", payload.Domain, err)
+			writeProviderError(ctx, "Failed to create TXT record", err)
+			return
+		}
+		fmt.Printf("Created ACME challenge: %s\n", name)
+
+		ctx.SetContentType("application/json")
+		ctx.WriteString(`{"status": "success"}`)
+	}
+}
+
+func handleACMECleanup(config *ServerConfig, zones *zoneRegistry) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		payload, status, err := verifySignedRequest(ctx.PostBody(), "acme-cleanup")
+		if err != nil {
+			writeJSONError(ctx, status, err.Error())
+			return
+		}
+
+		if payload.Value != "" && !acmeValuePattern.MatchString(payload.Value) {
+			writeJSONError(ctx, fasthttp.StatusBadRequest, "Invalid challenge value")
+			return
+		}
+
+		provider, err := zones.lookup(payload.Domain)
+		if err != nil {
+			fmt.Printf("Error finding zone for %s: %v\n", payload.Domain, err)
+			writeJSONError(ctx, fasthttp.StatusInternalServerError, "No DNS zone configured for domain")
+			return
+		}
+
+		name := acmeChallengeName(payload.Domain)
+		err = withRetry(config.Retry, "ACME cleanup for "+payload.Domain, func() error {
+			return provider.DeleteRecords(name, "TXT", payload.Value)
+		})
+		if err != nil {
+			fmt.Printf("Error removing ACME challenge for %s: %v\n", payload.Domain, err)
+			writeProviderError(ctx, "Failed to delete TXT record", err)
+			return
+		}
+		fmt.Printf("Removed ACME challenge: %s\n", name)
+
+		ctx.SetContentType("application/json")
+		ctx.WriteString(`{"status": "success"}`)
+	}
+}
+
+// isLegoHook reports whether args are lego's exec form:
+// "present|cleanup <fqdn> <value>".
+func isLegoHook(args []string) bool {
+	return len(args) == 3 && (args[0] == "present" || args[0] == "cleanup")
+}
+
+// acmeHookTarget returns the domain and challenge value of a hook call.
+// lego's exec provider passes "<fqdn> <value>", certbot uses environment variables.
+func acmeHookTarget(args []string) (string, string) {
+	var domain, value string
+	if len(args) >= 2 {
+		domain, value = args[0], args[1]
+	} else {
+		domain, value = os.Getenv("CERTBOT_DOMAIN"), os.Getenv("CERTBOT_VALIDATION")
+	}
+	return normalizeACMEDomain(domain), value
+}
+
+func runACMEHook(action string, args []string, wait time.Duration) {
+	if action != "present" && action != "cleanup" {
+		fmt.Printf("Unknown ACME action: %s (expected present or cleanup)\n", action)
+		os.Exit(1)
+	}
+
+	profiles, err := loadClientProfiles()
+	if err != nil {
+		fmt.Printf("Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+
+	domain, value := acmeHookTarget(args)
+	if domain == "" && len(profiles) == 1 {
+		domain = strings.ToLower(profiles[0].Domain)
+	}
+
+	var config *ClientConfig
+	for _, profile := range profiles {
+		if strings.ToLower(profile.Domain) == domain {
+			config = profile
+			break
+		}
+	}
+	if config == nil {
+		fmt.Printf("Domain %s does not match any configured domain\n", domain)
+		os.Exit(1)
+	}
+	if value == "" && action == "present" {
+		fmt.Println("Missing ACME challenge value")
+		os.Exit(1)
+	}
+
+	err = withServers(config, func(server ServerEntry) error {
+		return sendSignedRequest(server.URL, "/acme/"+action, config, SignedPayload{
+			Action: "acme-" + action,
+			Domain: config.Domain,
+			Value:  value,
+		})
+	})
+	if err != nil {
+		fmt.Printf("Error running ACME %s for %s: %v\n", action, acmeChallengeName(config.Domain), err)
+		os.Exit(1)
+	}
+	fmt.Printf("ACME %s successful for %s\n", action, acmeChallengeName(config.Domain))
+
+	if action == "present" && wait > 0 {
+		fmt.Printf("Waiting %s for DNS propagation...\n", wait)
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func serveSigned(t *testing.T, handler fasthttp.RequestHandler, client *ClientConfig, payload SignedPayload) int {
+	t.Helper()
+	body, err := newSignedRequest(client, payload)
+	if err != nil {
+		t.Fatalf("newSignedRequest: %v", err)
+	}
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetBody(body)
+	handler(&ctx)
+	return ctx.Response.StatusCode()
+}
+
+func challengeValues(t *testing.T, zones *zoneRegistry, domain string) []string {
+	t.Helper()
+	provider, err := zones.lookup(domain)
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	records, _ := provider.Records(acmeChallengeName(domain), "TXT")
+	var values []string
+	for _, record := range records {
+		values = append(values, record.Content)
+	}
+	return values
+}
+
+func TestACMEPresentAndCleanup(t *testing.T) {
+	client := newTestClient(t, "home.vozdns.vn")
+	useAuthorizedDomains(t, client)
+	config, zones := newTestDryRunZones(t)
+	present := handleACMEPresent(config, zones)
+	cleanup := handleACMECleanup(config, zones)
+
+	for _, value := range []string{"token-one", "token_two"} {
+		status := serveSigned(t, present, client, SignedPayload{Action: "acme-present", Domain: client.Domain, Value: value})
+		if status != fasthttp.StatusOK {
+			t.Fatalf("present %s: status %d", value, status)
+		}
+	}
+	if got := challengeValues(t, zones, client.Domain); !reflect.DeepEqual(got, []string{"token-one", "token_two"}) {
+		t.Fatalf("TXT records = %v", got)
+	}
+
+	status := serveSigned(t, cleanup, client, SignedPayload{Action: "acme-cleanup", Domain: client.Domain, Value: "token-one"})
+	if status != fasthttp.StatusOK {
+		t.Fatalf("cleanup: status %d", status)
+	}
+	if got := challengeValues(t, zones, client.Domain); !reflect.DeepEqual(got, []string{"token_two"}) {
+		t.Fatalf("TXT records after cleanup = %v", got)
+	}
+
+	// Cleanup without a value removes every challenge for the domain.
+	status = serveSigned(t, cleanup, client, SignedPayload{Action: "acme-cleanup", Domain: client.Domain})
+	if status != fasthttp.StatusOK {
+		t.Fatalf("cleanup all: status %d", status)
+	}
+	if got := challengeValues(t, zones, client.Domain); len(got) != 0 {
+		t.Fatalf("TXT records after cleanup all = %v", got)
+	}
+}
+
+func TestACMERejectsRequests(t *testing.T) {
+	client := newTestClient(t, "home.vozdns.vn")
+	other := newTestClient(t, "other.vozdns.vn")
+	useAuthorizedDomains(t, client)
+	config, zones := newTestDryRunZones(t)
+
+	tests := []struct {
+		name    string
+		cleanup bool
+		client  *ClientConfig
+		payload SignedPayload
+		status  int
+	}{
+		{name: "empty value", client: client, payload: SignedPayload{Action: "acme-present", Domain: client.Domain}, status: fasthttp.StatusBadRequest},
+		{name: "value with spaces", client: client, payload: SignedPayload{Action: "acme-present", Domain: client.Domain, Value: "a b"}, status: fasthttp.StatusBadRequest},
+		{name: "value with quotes", client: client, payload: SignedPayload{Action: "acme-present", Domain: client.Domain, Value: `a"b`}, status: fasthttp.StatusBadRequest},
+		{name: "cleanup value with a newline", cleanup: true, client: client, payload: SignedPayload{Action: "acme-cleanup", Domain: client.Domain, Value: "a\nb"}, status: fasthttp.StatusBadRequest},
+		{name: "wrong action", client: client, payload: SignedPayload{Action: "acme-cleanup", Domain: client.Domain, Value: "token"}, status: fasthttp.StatusBadRequest},
+		{name: "unauthorized domain", client: other, payload: SignedPayload{Action: "acme-present", Domain: other.Domain, Value: "token"}, status: fasthttp.StatusUnauthorized},
+		{name: "signed with another key", client: other, payload: SignedPayload{Action: "acme-present", Domain: client.Domain, Value: "token"}, status: fasthttp.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := handleACMEPresent(config, zones)
+			if test.cleanup {
+				handler = handleACMECleanup(config, zones)
+			}
+			if status := serveSigned(t, handler, test.client, test.payload); status != test.status {
+				t.Errorf("status = %d, want %d", status, test.status)
+			}
+			if got := challengeValues(t, zones, client.Domain); len(got) != 0 {
+				t.Errorf("TXT records = %v, want none", got)
+			}
+		})
+	}
+}
+
+func TestNormalizeACMEDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{domain: "home.vozdns.vn", want: "home.vozdns.vn"},
+		{domain: "Home.VozDNS.vn.", want: "home.vozdns.vn"},
+		{domain: "*.home.vozdns.vn", want: "home.vozdns.vn"},
+		{domain: "_acme-challenge.home.vozdns.vn.", want: "home.vozdns.vn"},
+		{domain: "_ACME-CHALLENGE.home.vozdns.vn", want: "home.vozdns.vn"},
+		{domain: "", want: ""},
+	}
+
+	for _, test := range tests {
+		if got := normalizeACMEDomain(test.domain); got != test.want {
+			t.Errorf("normalizeACMEDomain(%q) = %q, want %q", test.domain, got, test.want)
+		}
+	}
+}
+
+func TestACMEHookArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		lego bool
+	}{
+		{args: []string{"present", "_acme-challenge.home.vozdns.vn.", "token"}, lego: true},
+		{args: []string{"cleanup", "home.vozdns.vn", "token"}, lego: true},
+		{args: []string{"timeout", "home.vozdns.vn", "token"}},
+		{args: []string{"present", "home.vozdns.vn"}},
+		{args: nil},
+	}
+	for _, test := range tests {
+		if got := isLegoHook(test.args); got != test.lego {
+			t.Errorf("isLegoHook(%q) = %v, want %v", test.args, got, test.lego)
+		}
+	}
+
+	t.Setenv("CERTBOT_DOMAIN", "*.home.vozdns.vn")
+	t.Setenv("CERTBOT_VALIDATION", "from-env")
+
+	// lego: main passes everything after the action.
+	domain, value := acmeHookTarget([]string{"_acme-challenge.Home.vozdns.vn.", "token"})
+	if domain != "home.vozdns.vn" || value != "token" {
+		t.Errorf("lego target = %s %s", domain, value)
+	}
+	// certbot: no arguments, the challenge comes from the environment.
+	domain, value = acmeHookTarget(nil)
+	if domain != "home.vozdns.vn" || value != "from-env" {
+		t.Errorf("certbot target = %s %s", domain, value)
+	}
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSTTL         = 60
+	defaultDNSRefresh     = 3600
+	defaultDNSRetry       = 600
+	defaultDNSExpire      = 604800
+	defaultDNSListen      = ":53"
+	maxUDPResponseSize    = 512
+	ednsUDPSize           = 1232
+	axfrRecordsPerMessage = 100
+)
+
+type AuthoritativeConfig struct {
+	Listen        string      `json:"listen,omitempty"`
+	Nameservers   []string    `json:"nameservers"`
+	Hostmaster    string      `json:"hostmaster,omitempty"`
+	TTL           uint32      `json:"ttl,omitempty"`
+	NegativeTTL   uint32      `json:"negative_ttl,omitempty"`
+	Refresh       uint32      `json:"refresh,omitempty"`
+	Retry         uint32      `json:"retry,omitempty"`
+	Expire        uint32      `json:"expire,omitempty"`
+	AllowTransfer []string    `json:"allow_transfer,omitempty"`
+	Notify        []string    `json:"notify,omitempty"`
+	RecordsFile   string      `json:"records_file,omitempty"`
+	StaticRecords []DNSRecord `json:"static_records,omitempty"`
+}
+
+// authoritativeProvider answers DNS queries for its zone itself, over UDP and
+// TCP, from the records registered through it. Secondaries listed in
+// allow_transfer may AXFR the zone and are sent NOTIFY on every change.
+type authoritativeProvider struct {
+	zone   *ZoneConfig
+	config AuthoritativeConfig
+	origin string
+	store  recordStore
+
+	mu            sync.Mutex
+	serial        uint32
+	allowTransfer []*net.IPNet
+}
+
+func newAuthoritativeProvider(zone *ZoneConfig) (*authoritativeProvider, error) {
+	if zone.Name == "" {
+		return nil, fmt.Errorf("the authoritative provider needs a zone name, configure it in the \"zones\" map")
+	}
+	if zone.DNS == nil {
+		return nil, fmt.Errorf("the authoritative provider needs a \"dns\" block")
+	}
+
+	config := *zone.DNS
+	if config.Listen == "" {
+		config.Listen = defaultDNSListen
+	}
+	if config.TTL == 0 {
+		config.TTL = defaultDNSTTL
+	}
+	if config.NegativeTTL == 0 {
+		config.NegativeTTL = config.TTL
+	}
+	if config.Refresh == 0 {
+		config.Refresh = defaultDNSRefresh
+	}
+	if config.Retry == 0 {
+		config.Retry = defaultDNSRetry
+	}
+	if config.Expire == 0 {
+		config.Expire = defaultDNSExpire
+	}
+	if config.Hostmaster == "" {
+		config.Hostmaster = "hostmaster." + zone.Name
+	}
+
+	p := &authoritativeProvider{
+		zone:   zone,
+		config: config,
+		origin: zone.Name,
+		serial: uint32(time.Now().Unix()),
+	}
+
+	allowTransfer, err := parseNetworks(config.AllowTransfer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow_transfer: %v", err)
+	}
+	p.allowTransfer = allowTransfer
+
+	if config.RecordsFile != "" {
+		if err := p.store.load(config.RecordsFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func (p *authoritativeProvider) Name() string {
+	return "authoritative"
+}
+
+func (p *authoritativeProvider) Verify() error {
+	if len(p.config.Nameservers) == 0 {
+		return fmt.Errorf("dns.nameservers must list at least one name server")
+	}
+	names := append([]string{p.config.Hostmaster}, p.config.Nameservers...)
+	for _, name := range names {
+		if _, err := dnsmessage.NewName(fqdn(name)); err != nil {
+			return fmt.Errorf("invalid name %q: %v", name, err)
+		}
+	}
+	for _, record := range p.config.StaticRecords {
+		if _, err := p.resource(record); err != nil {
+			return fmt.Errorf("invalid static record %s %s: %v", record.Name, record.Type, err)
+		}
+	}
+	return nil
+}
+
+func (p *authoritativeProvider) Start() error {
+	udpConn, err := net.ListenPacket("udp", p.config.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp %s: %v", p.config.Listen, err)
+	}
+	tcpListener, err := net.Listen("tcp", p.config.Listen)
+	if err != nil {
+		udpConn.Close()
+		return fmt.Errorf("failed to listen on tcp %s: %v", p.config.Listen, err)
+	}
+
+	fmt.Printf("Authoritative DNS for %s listening on %s (udp/tcp)\n", p.origin, p.config.Listen)
+	go p.serveUDP(udpConn)
+	go p.serveTCP(tcpListener)
+	return nil
+}
+
+func (p *authoritativeProvider) Records(name, recordType string) ([]DNSRecord, error) {
+	return p.store.find(normalizeRecordName(name), recordType), nil
+}
+
+func (p *authoritativeProvider) ZoneRecords() ([]DNSRecord, error) {
+	return p.store.snapshot(), nil
+}
+
+func (p *authoritativeProvider) SetRecord(name, recordType, content string, proxied bool) (bool, error) {
+	changed := p.store.set(normalizeRecordName(name), recordType, content, false)
+	if !changed {
+		return false, nil
+	}
+	return true, p.changed()
+}
+
+func (p *authoritativeProvider) AddRecord(name, recordType, content string) error {
+	if !p.store.addUnique(normalizeRecordName(name), recordType, content) {
+		return nil
+	}
+	return p.changed()
+}
+
+func (p *authoritativeProvider) DeleteRecords(name, recordType, content string) error {
+	if !p.store.removeMatching(normalizeRecordName(name), recordType, content) {
+		return nil
+	}
+	return p.changed()
+}
+
+// changed bumps the SOA serial, saves the records and notifies secondaries.
+func (p *authoritativeProvider) changed() error {
+	p.mu.Lock()
+	serial := uint32(time.Now().Unix())
+	if serial <= p.serial {
+		serial = p.serial + 1
+	}
+	p.serial = serial
+	p.mu.Unlock()
+
+	if len(p.config.Notify) > 0 {
+		go p.sendNotify(serial)
+	}
+
+	if p.config.RecordsFile == "" {
+		return nil
+	}
+	return p.store.save(p.config.RecordsFile)
+}
+
+func (p *authoritativeProvider) currentSerial() uint32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.serial
+}
+
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+func (p *authoritativeProvider) inZone(name string) bool {
+	return name == p.origin || strings.HasSuffix(name, "."+p.origin)
+}
+
+func (p *authoritativeProvider) soaResource() dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(fqdn(p.origin)),
+			Type:  dnsmessage.TypeSOA,
+			Class: dnsmessage.ClassINET,
+			TTL:   p.config.TTL,
+		},
+		Body: &dnsmessage.SOAResource{
+			NS:      dnsmessage.MustNewName(fqdn(p.config.Nameservers[0])),
+			MBox:    dnsmessage.MustNewName(fqdn(p.config.Hostmaster)),
+			Serial:  p.currentSerial(),
+			Refresh: p.config.Refresh,
+			Retry:   p.config.Retry,
+			Expire:  p.config.Expire,
+			MinTTL:  p.config.NegativeTTL,
+		},
+	}
+}
+
+func (p *authoritativeProvider) nsResources() []dnsmessage.Resource {
+	var resources []dnsmessage.Resource
+	for _, nameserver := range p.config.Nameservers {
+		resources = append(resources, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName(fqdn(p.origin)),
+				Type:  dnsmessage.TypeNS,
+				Class: dnsmessage.ClassINET,
+				TTL:   p.config.TTL,
+			},
+			Body: &dnsmessage.NSResource{NS: dnsmessage.MustNewName(fqdn(nameserver))},
+		})
+	}
+	return resources
+}
+
+func (p *authoritativeProvider) resource(record DNSRecord) (dnsmessage.Resource, error) {
+	name, err := dnsmessage.NewName(fqdn(record.Name))
+	if err != nil {
+		return dnsmessage.Resource{}, err
+	}
+	header := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: p.config.TTL}
+
+	switch record.Type {
+	case "A":
+		ip := net.ParseIP(record.Content).To4()
+		if ip == nil {
+			return dnsmessage.Resource{}, fmt.Errorf("invalid IPv4 address %q", record.Content)
+		}
+		header.Type = dnsmessage.TypeA
+		body := &dnsmessage.AResource{}
+		copy(body.A[:], ip)
+		return dnsmessage.Resource{Header: header, Body: body}, nil
+	case "AAAA":
+		ip := net.ParseIP(record.Content)
+		if ip == nil || ip.To4() != nil {
+			return dnsmessage.Resource{}, fmt.Errorf("invalid IPv6 address %q", record.Content)
+		}
+		header.Type = dnsmessage.TypeAAAA
+		body := &dnsmessage.AAAAResource{}
+		copy(body.AAAA[:], ip.To16())
+		return dnsmessage.Resource{Header: header, Body: body}, nil
+	case "TXT":
+		header.Type = dnsmessage.TypeTXT
+		return dnsmessage.Resource{Header: header, Body: &dnsmessage.TXTResource{TXT: []string{record.Content}}}, nil
+	case "CNAME":
+		target, err := dnsmessage.NewName(fqdn(record.Content))
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+		header.Type = dnsmessage.TypeCNAME
+		return dnsmessage.Resource{Header: header, Body: &dnsmessage.CNAMEResource{CNAME: target}}, nil
+	default:
+		return dnsmessage.Resource{}, fmt.Errorf("unsupported record type %s", record.Type)
+	}
+}
+
+// allRecords returns the registered records followed by the static ones.
+func (p *authoritativeProvider) allRecords() []DNSRecord {
+	records := p.store.snapshot()
+	for _, record := range p.config.StaticRecords {
+		record.Name = normalizeRecordName(record.Name)
+		records = append(records, record)
+	}
+	return records
+}
+
+// answer returns the resources for a question and whether the name exists
+// at all, which separates NODATA from NXDOMAIN.
+func (p *authoritativeProvider) answer(name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, bool) {
+	var answers []dnsmessage.Resource
+	exists := name == p.origin
+
+	if name == p.origin {
+		if qtype == dnsmessage.TypeSOA || qtype == dnsmessage.TypeALL {
+			answers = append(answers, p.soaResource())
+		}
+		if qtype == dnsmessage.TypeNS || qtype == dnsmessage.TypeALL {
+			answers = append(answers, p.nsResources()...)
+		}
+	}
+
+	for _, record := range p.allRecords() {
+		if record.Name != name {
+			if strings.HasSuffix(record.Name, "."+name) {
+				exists = true
+			}
+			continue
+		}
+		exists = true
+
+		resource, err := p.resource(record)
+		if err != nil {
+			continue
+		}
+		if qtype == dnsmessage.TypeALL || resource.Header.Type == qtype || resource.Header.Type == dnsmessage.TypeCNAME {
+			answers = append(answers, resource)
+		}
+	}
+
+	return answers, exists
+}
+
+// handleQuery builds the response to a single DNS query. It returns nil for
+// messages that should be dropped.
+func (p *authoritativeProvider) handleQuery(msg []byte, tcp bool) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil || header.Response {
+		return nil
+	}
+
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               header.ID,
+			Response:         true,
+			OpCode:           header.OpCode,
+			RecursionDesired: header.RecursionDesired,
+		},
+	}
+
+	question, err := parser.Question()
+	if err != nil {
+		response.Header.RCode = dnsmessage.RCodeFormatError
+		return packResponse(response, maxUDPResponseSize)
+	}
+	response.Questions = []dnsmessage.Question{question}
+
+	maxSize := maxUDPResponseSize
+	parser.SkipAllQuestions()
+	parser.SkipAllAnswers()
+	parser.SkipAllAuthorities()
+	for {
+		additional, err := parser.AdditionalHeader()
+		if err != nil {
+			break
+		}
+		if additional.Type == dnsmessage.TypeOPT {
+			if int(additional.Class) > maxSize {
+				maxSize = int(additional.Class)
+			}
+			if maxSize > ednsUDPSize {
+				maxSize = ednsUDPSize
+			}
+			var opt dnsmessage.ResourceHeader
+			opt.SetEDNS0(ednsUDPSize, dnsmessage.RCodeSuccess, false)
+			response.Additionals = append(response.Additionals, dnsmessage.Resource{Header: opt, Body: &dnsmessage.OPTResource{}})
+		}
+		parser.SkipAdditional()
+	}
+	if tcp {
+		maxSize = 65535
+	}
+
+	if header.OpCode != 0 {
+		response.Header.RCode = dnsmessage.RCodeNotImplemented
+		return packResponse(response, maxSize)
+	}
+
+	name := normalizeRecordName(question.Name.String())
+	if question.Class != dnsmessage.ClassINET || !p.inZone(name) || question.Type == dnsmessage.TypeAXFR {
+		response.Header.RCode = dnsmessage.RCodeRefused
+		return packResponse(response, maxSize)
+	}
+
+	response.Header.Authoritative = true
+	answers, exists := p.answer(name, question.Type)
+	response.Answers = answers
+	if len(answers) == 0 {
+		if !exists {
+			response.Header.RCode = dnsmessage.RCodeNameError
+		}
+		response.Authorities = []dnsmessage.Resource{p.soaResource()}
+	}
+
+	return packResponse(response, maxSize)
+}
+
+// packResponse packs the message, falling back to an empty truncated answer
+// when it does not fit so the resolver retries over TCP.
+func packResponse(response dnsmessage.Message, maxSize int) []byte {
+	packed, err := response.Pack()
+	if err != nil {
+		return nil
+	}
+	if len(packed) <= maxSize {
+		return packed
+	}
+
+	response.Header.Truncated = true
+	response.Answers = nil
+	response.Authorities = nil
+	packed, err = response.Pack()
+	if err != nil {
+		return nil
+	}
+	return packed
+}
+
+func (p *authoritativeProvider) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			fmt.Printf("DNS UDP listener stopped: %v\n", err)
+			return
+		}
+
+		if response := p.handleQuery(buf[:n], false); response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (p *authoritativeProvider) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Printf("DNS TCP listener stopped: %v\n", err)
+			return
+		}
+		go p.handleTCPConn(conn)
+	}
+}
+
+func (p *authoritativeProvider) handleTCPConn(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		msg := make([]byte, length)
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+
+		if isAXFR(msg) {
+			p.transfer(conn, msg)
+			return
+		}
+
+		response := p.handleQuery(msg, true)
+		if response == nil || writeTCPMessage(conn, response) != nil {
+			return
+		}
+	}
+}
+
+func writeTCPMessage(conn net.Conn, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := conn.Write(buf)
+	return err
+}
+
+func isAXFR(msg []byte) bool {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(msg); err != nil {
+		return false
+	}
+	question, err := parser.Question()
+	return err == nil && question.Type == dnsmessage.TypeAXFR
+}
+
+func (p *authoritativeProvider) transferAllowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range p.allowTransfer {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// transfer sends the whole zone as an AXFR: SOA, NS, every record and the
+// SOA again, split over several messages for large zones.
+func (p *authoritativeProvider) transfer(conn net.Conn, msg []byte) {
+	var parser dnsmessage.Parser
+	header, _ := parser.Start(msg)
+	question, _ := parser.Question()
+
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:            header.ID,
+			Response:      true,
+			Authoritative: true,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+
+	if normalizeRecordName(question.Name.String()) != p.origin || !p.transferAllowed(conn.RemoteAddr()) {
+		fmt.Printf("Refused zone transfer of %s to %s\n", question.Name.String(), conn.RemoteAddr())
+		response.Header.RCode = dnsmessage.RCodeRefused
+		if packed, err := response.Pack(); err == nil {
+			writeTCPMessage(conn, packed)
+		}
+		return
+	}
+
+	soa := p.soaResource()
+	resources := append([]dnsmessage.Resource{soa}, p.nsResources()...)
+	for _, record := range p.allRecords() {
+		if resource, err := p.resource(record); err == nil {
+			resources = append(resources, resource)
+		}
+	}
+	resources = append(resources, soa)
+
+	for start := 0; start < len(resources); start += axfrRecordsPerMessage {
+		end := start + axfrRecordsPerMessage
+		if end > len(resources) {
+			end = len(resources)
+		}
+
+		response.Answers = resources[start:end]
+		packed, err := response.Pack()
+		if err != nil {
+			fmt.Printf("Error packing zone transfer: %v\n", err)
+			return
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := writeTCPMessage(conn, packed); err != nil {
+			return
+		}
+		response.Questions = nil
+	}
+
+	fmt.Printf("Transferred zone %s to %s (%d records)\n", p.origin, conn.RemoteAddr(), len(resources))
+}
+
+// sendNotify tells the secondaries in dns.notify that the zone changed, so
+// they transfer it without waiting for the SOA refresh interval.
+func (p *authoritativeProvider) sendNotify(serial uint32) {
+	notify := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:            uint16(serial),
+			OpCode:        4,
+			Authoritative: true,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(fqdn(p.origin)),
+			Type:  dnsmessage.TypeSOA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := notify.Pack()
+	if err != nil {
+		return
+	}
+
+	for _, address := range p.config.Notify {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "53")
+		}
+		conn, err := net.DialTimeout("udp", address, 5*time.Second)
+		if err != nil {
+			fmt.Printf("Error sending NOTIFY to %s: %v\n", address, err)
+			continue
+		}
+		conn.Write(packed)
+		conn.Close()
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTestAuthoritative(t *testing.T) *authoritativeProvider {
+	t.Helper()
+	p, err := newAuthoritativeProvider(&ZoneConfig{
+		Name: "vozdns.vn",
+		DNS: &AuthoritativeConfig{
+			Nameservers:   []string{"ns1.vozdns.vn"},
+			StaticRecords: []DNSRecord{{Name: "www.vozdns.vn", Type: "CNAME", Content: "home.vozdns.vn"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("newAuthoritativeProvider: %v", err)
+	}
+	if _, err := p.SetRecord("home.vozdns.vn", "A", "203.0.113.7", false); err != nil {
+		t.Fatalf("SetRecord: %v", err)
+	}
+	if _, err := p.SetRecord("v6.home.vozdns.vn", "AAAA", "2001:db8::7", false); err != nil {
+		t.Fatalf("SetRecord: %v", err)
+	}
+	return p
+}
+
+func buildQuery(t *testing.T, name string, qtype dnsmessage.Type, class dnsmessage.Class, opCode dnsmessage.OpCode) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42, OpCode: opCode, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: class}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	return packed
+}
+
+func TestHandleQuery(t *testing.T) {
+	tests := []struct {
+		name          string
+		qname         string
+		qtype         dnsmessage.Type
+		class         dnsmessage.Class
+		opCode        dnsmessage.OpCode
+		rcode         dnsmessage.RCode
+		authoritative bool
+		answers       []dnsmessage.Type
+		authorities   int
+	}{
+		{name: "A", qname: "home.vozdns.vn.", qtype: dnsmessage.TypeA, authoritative: true, answers: []dnsmessage.Type{dnsmessage.TypeA}},
+		{name: "case insensitive", qname: "HOME.vozdns.vn.", qtype: dnsmessage.TypeA, authoritative: true, answers: []dnsmessage.Type{dnsmessage.TypeA}},
+		{name: "AAAA", qname: "v6.home.vozdns.vn.", qtype: dnsmessage.TypeAAAA, authoritative: true, answers: []dnsmessage.Type{dnsmessage.TypeAAAA}},
+		{name: "static CNAME", qname: "www.vozdns.vn.", qtype: dnsmessage.TypeA, authoritative: true, answers: []dnsmessage.Type{dnsmessage.TypeCNAME}},
+		{name: "SOA", qname: "vozdns.vn.", qtype: dnsmessage.TypeSOA, authoritative: true, answers: []dnsmessage.Type{dnsmessage.TypeSOA}},
+		{name: "NS", qname: "vozdns.vn.", qtype: dnsmessage.TypeNS, authoritative: true, answers: []dnsmessage.Type{dnsmessage.TypeNS}},
+		{name: "NODATA", qname: "home.vozdns.vn.", qtype: dnsmessage.TypeAAAA, authoritative: true, authorities: 1},
+		{name: "empty non-terminal", qname: "v6.home.vozdns.vn.", qtype: dnsmessage.TypeA, authoritative: true, authorities: 1},
+		{name: "NXDOMAIN", qname: "missing.vozdns.vn.", qtype: dnsmessage.TypeA, rcode: dnsmessage.RCodeNameError, authoritative: true, authorities: 1},
+		{name: "other zone", qname: "example.com.", qtype: dnsmessage.TypeA, rcode: dnsmessage.RCodeRefused},
+		{name: "AXFR over UDP", qname: "vozdns.vn.", qtype: dnsmessage.TypeAXFR, rcode: dnsmessage.RCodeRefused},
+		{name: "CHAOS class", qname: "home.vozdns.vn.", qtype: dnsmessage.TypeA, class: dnsmessage.ClassCHAOS, rcode: dnsmessage.RCodeRefused},
+		{name: "not a query", qname: "home.vozdns.vn.", qtype: dnsmessage.TypeA, opCode: 2, rcode: dnsmessage.RCodeNotImplemented},
+	}
+
+	p := newTestAuthoritative(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			class := test.class
+			if class == 0 {
+				class = dnsmessage.ClassINET
+			}
+
+			packed := p.handleQuery(buildQuery(t, test.qname, test.qtype, class, test.opCode), false)
+			if packed == nil {
+				t.Fatal("query was dropped")
+			}
+			var response dnsmessage.Message
+			if err := response.Unpack(packed); err != nil {
+				t.Fatalf("Unpack: %v", err)
+			}
+
+			if response.Header.ID != 42 || !response.Header.Response {
+				t.Errorf("header = %+v", response.Header)
+			}
+			if response.Header.RCode != test.rcode {
+				t.Errorf("rcode = %v, want %v", response.Header.RCode, test.rcode)
+			}
+			if response.Header.Authoritative != test.authoritative {
+				t.Errorf("authoritative = %v, want %v", response.Header.Authoritative, test.authoritative)
+			}
+			if len(response.Answers) != len(test.answers) {
+				t.Fatalf("got %d answers, want %d", len(response.Answers), len(test.answers))
+			}
+			for i, answer := range response.Answers {
+				if answer.Header.Type != test.answers[i] {
+					t.Errorf("answer %d type = %v, want %v", i, answer.Header.Type, test.answers[i])
+				}
+			}
+			if len(response.Authorities) != test.authorities {
+				t.Errorf("got %d authorities, want %d", len(response.Authorities), test.authorities)
+			}
+		})
+	}
+}
+
+func TestHandleQueryDropsResponses(t *testing.T) {
+	p := newTestAuthoritative(t)
+	msg := dnsmessage.Message{Header: dnsmessage.Header{ID: 1, Response: true}}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	if p.handleQuery(packed, false) != nil {
+		t.Error("answered a response")
+	}
+	if p.handleQuery([]byte{0x01}, false) != nil {
+		t.Error("answered a malformed message")
+	}
+}
+
+func TestHandleQueryTruncates(t *testing.T) {
+	p := newTestAuthoritative(t)
+	for i := 0; i < 40; i++ {
+		if err := p.AddRecord("many.vozdns.vn", "AAAA", fmt.Sprintf("2001:db8::%x", i+1)); err != nil {
+			t.Fatalf("AddRecord: %v", err)
+		}
+	}
+
+	query := buildQuery(t, "many.vozdns.vn.", dnsmessage.TypeAAAA, dnsmessage.ClassINET, 0)
+	var udp, tcp dnsmessage.Message
+	if err := udp.Unpack(p.handleQuery(query, false)); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if !udp.Header.Truncated || len(udp.Answers) != 0 {
+		t.Errorf("UDP answer not truncated: truncated=%v answers=%d", udp.Header.Truncated, len(udp.Answers))
+	}
+	if err := tcp.Unpack(p.handleQuery(query, true)); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if tcp.Header.Truncated || len(tcp.Answers) != 40 {
+		t.Errorf("TCP answer: truncated=%v answers=%d, want 40", tcp.Header.Truncated, len(tcp.Answers))
+	}
+}
@@ -1,7 +1,10 @@
 #!/bin/bash
 
-GOOS=windows GOARCH=amd64 go build -o ./build/vozdns.exe
-GOOS=darwin GOARCH=amd64 go build -a -installsuffix cgo -ldflags="-s -w -extldflags=-static" -o ./build/vozdns_amd64_darwin
-GOOS=darwin GOARCH=arm64 go build -a -installsuffix cgo -ldflags="-s -w -extldflags=-static" -o ./build/vozdns_arm64_darwin
-CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -a -installsuffix cgo -ldflags="-s -w -extldflags=-static" -o ./build/vozdns_amd64
-CGO_ENABLED=0 GOOS=linux GOARCH=arm64 go build -a -installsuffix cgo -ldflags="-s -w -extldflags=-static" -o ./build/vozdns_arm64
\ No newline at end of file
+# The public half of the maintainers' discovery key, see -generate-discovery-key
+KEY="-X main.discoveryPublicKey=$DISCOVERY_PUBLIC_KEY"
+
+GOOS=windows GOARCH=amd64 go build -ldflags="$KEY" -o ./build/vozdns.exe
+GOOS=darwin GOARCH=amd64 go build -a -installsuffix cgo -ldflags="-s -w -extldflags=-static $KEY" -o ./build/vozdns_amd64_darwin
+GOOS=darwin GOARCH=arm64 go build -a -installsuffix cgo -ldflags="-s -w -extldflags=-static $KEY" -o ./build/vozdns_arm64_darwin
+CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -a -installsuffix cgo -ldflags="-s -w -extldflags=-static $KEY" -o ./build/vozdns_amd64
+CGO_ENABLED=0 GOOS=linux GOARCH=arm64 go build -a -installsuffix cgo -ldflags="-s -w -extldflags=-static $KEY" -o ./build/vozdns_arm64
\ No newline at end of file
@@ -3,47 +3,22 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
-)
-
-func getPublicIP() (string, error) {
-	resp, err := http.Get("https://icanhazip.com")
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-
-	ip := string(bytes.TrimSpace(body))
-	return ip, nil
-}
-
-func getServerInfo() (*ServerInfo, error) {
-	resp, err := http.Get("https://vozdns.vn/server.json")
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	var serverInfo ServerInfo
-	err = json.NewDecoder(resp.Body).Decode(&serverInfo)
-	if err != nil {
-		return nil, err
-	}
-
-	return &serverInfo, nil
-}
+	"github.com/tidwall/gjson"
+)
 
 func verifyWithServer(serverURL string, config *ClientConfig, ip string) (*VerifyResponse, error) {
 	verifyReq := VerifyRequest{
@@ -57,14 +32,15 @@ func verifyWithServer(serverURL string, config *ClientConfig, ip string) (*Verif
 		return nil, err
 	}
 
-	resp, err := http.Post(fmt.Sprintf("%s/verify", serverURL), "application/json", bytes.NewBuffer(reqData))
+	resp, err := serverHTTPClient.Post(fmt.Sprintf("%s/verify", serverURL), "application/json", bytes.NewBuffer(reqData))
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server returned status: %d", resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &serverError{Status: resp.StatusCode, Body: string(body)}
 	}
 
 	encryptedData, err := io.ReadAll(resp.Body)
@@ -91,7 +67,8 @@ func verifyWithServer(serverURL string, config *ClientConfig, ip string) (*Verif
 	return &verifyResp, nil
 }
 
-func registerWithServer(serverURL string, config *ClientConfig, ip string, serverPublicKey string) error {
+// registerWithServer reports whether the server changed the DNS record.
+func registerWithServer(serverURL string, config *ClientConfig, ip string, serverPublicKey string) (bool, error) {
 
 	registerData := map[string]interface{}{
 		"domain":    config.Domain,
@@ -101,25 +78,59 @@ func registerWithServer(serverURL string, config *ClientConfig, ip string, serve
 
 	registerJSON, err := json.Marshal(registerData)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	serverPubKey, err := decodePublicKey(serverPublicKey)
 	if err != nil {
-		return fmt.Errorf("error decoding server public key: %v", err)
+		return false, fmt.Errorf("error decoding server public key: %v", err)
 	}
 
 	encryptedData, err := encryptWithPublicKey(registerJSON, serverPubKey)
 	if err != nil {
-		return fmt.Errorf("error encrypting data: %v", err)
+		return false, fmt.Errorf("error encrypting data: %v", err)
 	}
 
 	reqData, err := json.Marshal(map[string]string{"encrypted_data": encryptedData})
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := serverHTTPClient.Post(fmt.Sprintf("%s/register", serverURL), "application/json", bytes.NewBuffer(reqData))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return false, &serverError{
+			Status:     resp.StatusCode,
+			Retryable:  gjson.GetBytes(body, "retryable").Bool(),
+			RetryAfter: retryAfterFromHeaders(resp.Header),
+			Body:       string(body),
+		}
+	}
+
+	// Mirrored zones may accept the update even though a mirror failed.
+	for _, provider := range gjson.GetBytes(body, "providers").Array() {
+		if provider.Get("status").String() == "failed" {
+			fmt.Printf("Warning: DNS provider %s failed: %s\n", provider.Get("provider").String(), provider.Get("error").String())
+		}
+	}
+
+	// Servers that predate the "updated" field always count as an update.
+	updated := gjson.GetBytes(body, "updated")
+	return !updated.Exists() || updated.Bool(), nil
+}
+
+func sendSignedRequest(serverURL, path string, config *ClientConfig, payload SignedPayload) error {
+	reqData, err := newSignedRequest(config, payload)
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.Post(fmt.Sprintf("%s/register", serverURL), "application/json", bytes.NewBuffer(reqData))
+	resp, err := serverHTTPClient.Post(serverURL+path, "application/json", bytes.NewBuffer(reqData))
 	if err != nil {
 		return err
 	}
@@ -127,22 +138,145 @@ func registerWithServer(serverURL string, config *ClientConfig, ip string, serve
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("server returned status: %d, body: %s", resp.StatusCode, string(body))
+		return &serverError{Status: resp.StatusCode, Body: string(body)}
 	}
 
 	return nil
 }
 
+// newSignedRequest timestamps payload and signs it with the client's key.
+func newSignedRequest(config *ClientConfig, payload SignedPayload) ([]byte, error) {
+	payload.Timestamp = time.Now().Unix()
+
+	payloadData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	clientPrivateKey, err := decodePrivateKey(config.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding private key: %v", err)
+	}
+
+	signature, err := signData(payloadData, clientPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error signing request: %v", err)
+	}
+
+	return json.Marshal(SignedRequest{
+		Data:      base64.StdEncoding.EncodeToString(payloadData),
+		Signature: signature,
+	})
+}
+
+// serverError is a non-200 answer from the VozDNS server. Retryable is set
+// when the server hit a transient DNS provider failure.
+type serverError struct {
+	Status     int
+	Retryable  bool
+	RetryAfter time.Duration
+	Body       string
+}
+
+func (e *serverError) Error() string {
+	return fmt.Sprintf("server returned status: %d, body: %s", e.Status, e.Body)
+}
+
+func unregisterFromServer(config *ClientConfig) error {
+	return withServers(config, func(server ServerEntry) error {
+		return sendSignedRequest(server.URL, "/unregister", config, SignedPayload{
+			Action: "unregister",
+			Domain: config.Domain,
+		})
+	})
+}
+
+// unregisterProfiles removes the records of each profile's domain. The
+// server deletes both the A and the AAAA record, so a domain with a profile
+// per IP family is only unregistered once. It reports whether all succeeded.
+func unregisterProfiles(profiles []*ClientConfig, state *clientState) bool {
+	results := make(map[string]error)
+	ok := true
+	for _, config := range profiles {
+		domain := normalizeRecordName(config.Domain)
+		err, done := results[domain]
+		if !done {
+			err = unregisterFromServer(config)
+			results[domain] = err
+			if err != nil {
+				fmt.Printf("Error removing DNS records for %s: %v\n", config.Domain, err)
+				ok = false
+			} else {
+				fmt.Printf("Removed DNS records for %s\n", config.Domain)
+			}
+		}
+		if err != nil || state == nil {
+			continue
+		}
+		if err := state.forget(profileStateKey(config)); err != nil {
+			fmt.Printf("Error saving client state: %v\n", err)
+		}
+	}
+	return ok
+}
+
+// unregisterClient removes the records of every domain profile, or only of
+// domain when it is not empty.
+func unregisterClient(domain string) {
+	profiles, err := loadClientProfiles()
+	if err != nil {
+		fmt.Printf("Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+
+	state, err := loadClientState()
+	if err != nil {
+		fmt.Printf("Error loading client state: %v\n", err)
+	}
+
+	var selected []*ClientConfig
+	for _, config := range profiles {
+		if domain == "" || normalizeRecordName(config.Domain) == normalizeRecordName(domain) {
+			selected = append(selected, config)
+		}
+	}
+
+	if len(selected) == 0 {
+		fmt.Printf("No profile for domain %s\n", domain)
+		os.Exit(1)
+	}
+	if !unregisterProfiles(selected, state) {
+		os.Exit(1)
+	}
+}
+
 func startClient() {
 	fmt.Println("Starting VozDNS client...")
 
-	config, err := loadClientConfig()
+	profiles, err := loadClientProfiles()
 	if err != nil {
 		fmt.Printf("Error loading config: %v\n", err)
 		return
 	}
 
-	fmt.Printf("Loaded config for domain: %s\n", config.Domain)
+	for _, config := range profiles {
+		fmt.Printf("Loaded config for domain: %s\n", config.Domain)
+	}
+
+	state, err := loadClientState()
+	if err != nil {
+		fmt.Printf("Error loading client state: %v\n", err)
+		return
+	}
+
+	// The health endpoint covers every profile, so it is only read from the
+	// top level of config.json.
+	if config, err := loadClientConfig(); err == nil && healthListen(config) != "" {
+		if err := startHealthServer(config, profiles, state); err != nil {
+			fmt.Printf("Error starting health endpoint: %v\n", err)
+			return
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -150,64 +284,328 @@ func startClient() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	ticker := time.NewTicker(10 * time.Minute)
-	defer ticker.Stop()
-
-	runClientCycle(config)
+	// Network changes trigger a cycle right away instead of waiting for the
+	// timer, which stays as a safety net.
+	profileChanges := watchProfileNetworks(ctx, profiles)
+
+	var wg sync.WaitGroup
+	for i, config := range profiles {
+		wg.Add(1)
+		go func(config *ClientConfig, changes <-chan struct{}) {
+			defer wg.Done()
+			runProfile(ctx, config, state, changes)
+		}(config, profileChanges[i])
+	}
 
 	fmt.Println("VozDNS client started. Press Ctrl+C to stop.")
 
+	<-sigChan
+	fmt.Println("\nReceived shutdown signal, stopping VozDNS client...")
+	cancel()
+	wg.Wait()
+
+	var remove []*ClientConfig
+	for _, config := range profiles {
+		if isSet(config.RemoveOnShutdown) {
+			remove = append(remove, config)
+		}
+	}
+	unregisterProfiles(remove, state)
+}
+
+// Replaced in tests.
+var (
+	networkWatcher = watchNetworkChanges
+	profileCycle   = runClientCycle
+)
+
+// watchProfileNetworks returns a channel per profile that is notified when
+// the network changes, or nil for profiles with disable_network_watch. One
+// watcher feeds every profile.
+func watchProfileNetworks(ctx context.Context, profiles []*ClientConfig) []chan struct{} {
+	profileChanges := make([]chan struct{}, len(profiles))
+	watch := false
+	for i, config := range profiles {
+		if !isSet(config.DisableNetworkWatch) {
+			profileChanges[i] = make(chan struct{}, 1)
+			watch = true
+		}
+	}
+	if !watch {
+		return profileChanges
+	}
+
+	networkChanges, err := networkWatcher(ctx)
+	if err != nil {
+		fmt.Printf("Not watching for network changes: %v\n", err)
+		return profileChanges
+	}
+	go func() {
+		for range networkChanges {
+			for _, changes := range profileChanges {
+				if changes != nil {
+					notifyNetworkChange(changes)
+				}
+			}
+		}
+	}()
+	return profileChanges
+}
+
+// notifyNetworkChange queues a change without blocking; one pending change
+// is enough to trigger a check.
+func notifyNetworkChange(events chan struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
+
+// runProfile keeps one domain up to date until ctx is cancelled. Each
+// profile has its own timer, so their schedules do not affect each other.
+func runProfile(ctx context.Context, config *ClientConfig, state *clientState, networkChanges <-chan struct{}) {
+	timer := time.NewTimer(nextCheckDelay(config))
+	defer timer.Stop()
+
+	var retry <-chan time.Time
+	var debounce <-chan time.Time
+	runCycle := func() {
+		retry = nil
+		debounce = nil
+		result := profileCycle(config, state)
+		delay := nextCheckDelay(config)
+		timer.Reset(delay)
+		if result.RetryAfter > 0 {
+			retry = time.After(result.RetryAfter)
+			if result.RetryAfter < delay {
+				delay = result.RetryAfter
+			}
+		}
+		state.setNextCheck(profileStateKey(config), time.Now().Add(delay))
+	}
+
+	runCycle()
+
 	for {
 		select {
 		case <-ctx.Done():
-			fmt.Println("Client context cancelled, shutting down...")
-			return
-		case <-sigChan:
-			fmt.Println("\nReceived shutdown signal, stopping VozDNS client...")
-			cancel()
 			return
-		case <-ticker.C:
-			runClientCycle(config)
+		case <-timer.C:
+			runCycle()
+		case <-retry:
+			runCycle()
+		case <-networkChanges:
+			debounce = time.After(networkChangeDebounce)
+		case <-debounce:
+			fmt.Printf("Network change detected, checking %s\n", config.Domain)
+			runCycle()
 		}
 	}
 }
 
-var lastIP string
+const (
+	defaultClientRetryAfter = 30 * time.Second
+	maxClientRetryAfter     = 5 * time.Minute
+	defaultCheckInterval    = 10 * time.Minute
+	defaultForceRefresh     = 24 * time.Hour
+)
+
+// networkChangeDebounce lets a burst of address and route changes settle
+// before the check runs.
+var networkChangeDebounce = 3 * time.Second
 
-func runClientCycle(config *ClientConfig) {
-	fmt.Printf("[%s] Starting client cycle...\n", time.Now().Format("2006-01-02 15:04:05"))
+// nextCheckDelay returns check_interval plus a random share of jitter, so
+// clients started together do not hit the server at the same moment.
+func nextCheckDelay(config *ClientConfig) time.Duration {
+	interval := time.Duration(config.CheckInterval)
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
+	if config.Jitter > 0 {
+		interval += time.Duration(rand.Int63n(int64(config.Jitter)))
+	}
+	return interval
+}
 
-	ip, err := getPublicIP()
+// forceRefreshInterval is how long an unchanged IP is trusted before it is
+// registered again, in case the record was lost on the server's side.
+func forceRefreshInterval(config *ClientConfig) time.Duration {
+	if config.ForceRefresh > 0 {
+		return time.Duration(config.ForceRefresh)
+	}
+	return defaultForceRefresh
+}
+
+// Outcomes of a client cycle, reported by -once.
+const (
+	cycleUpdated      = "updated"
+	cycleUnchanged    = "unchanged"
+	cycleIPFailed     = "ip_failed"
+	cycleUnreachable  = "unreachable"
+	cycleUnauthorized = "unauthorized"
+	cycleDNSFailed    = "dns_failed"
+	cycleFailed       = "failed"
+)
+
+// Steps of the server exchange, used in error messages.
+const (
+	stepFindServer = "Error finding a server"
+	stepVerify     = "Error verifying with server"
+	stepRegister   = "Error registering with server"
+)
+
+// cycleResult is what one client cycle did. RetryAfter is set when the
+// server asked for an early retry after a temporary DNS provider failure.
+type cycleResult struct {
+	Domain     string        `json:"domain"`
+	Outcome    string        `json:"outcome"`
+	IP         string        `json:"ip,omitempty"`
+	Server     string        `json:"server,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	RetryAfter time.Duration `json:"-"`
+}
+
+// runClientCycle checks the public IP and registers it when it changed.
+func runClientCycle(config *ClientConfig, state *clientState) *cycleResult {
+	fmt.Printf("[%s] Starting client cycle for %s...\n", time.Now().Format("2006-01-02 15:04:05"), config.Domain)
+
+	result := &cycleResult{Domain: config.Domain}
+	fail := func(outcome, message string, err error) *cycleResult {
+		fmt.Printf("%s: %v\n", message, err)
+		if err := state.recordFailure(profileStateKey(config), fmt.Errorf("%s: %v", message, err)); err != nil {
+			fmt.Printf("Error saving client state: %v\n", err)
+		}
+		result.Outcome = outcome
+		result.Error = fmt.Sprintf("%s: %v", message, err)
+		return result
+	}
+
+	ip, err := getPublicIP(config)
 	if err != nil {
-		fmt.Printf("Error getting public IP: %v\n", err)
-		return
+		return fail(cycleIPFailed, "Error getting public IP", err)
 	}
 	fmt.Printf("Public IP: %s\n", ip)
-
-	if ip == lastIP {
-		fmt.Println("Public IP unchanged, skipping update.")
-		return
+	result.IP = ip
+
+	if ip == state.lastIP(profileStateKey(config), ipFamily(ip)) {
+		if time.Now().Before(state.nextRefresh(profileStateKey(config))) {
+			fmt.Println("Public IP unchanged, skipping update.")
+			state.recordCheck(profileStateKey(config))
+			result.Outcome = cycleUnchanged
+			return result
+		}
+		fmt.Println("Public IP unchanged, refreshing registration")
 	}
 
-	serverInfo, err := getServerInfo()
+	// The verify and register steps must reach the same server, as the
+	// register request is encrypted with the key returned by verify.
+	step := stepFindServer
+	var updated bool
+	err = withServers(config, func(server ServerEntry) error {
+		fmt.Printf("Server: %s\n", server.URL)
+		result.Server = server.URL
+
+		step = stepVerify
+		verifyResp, err := verifyWithServer(server.URL, config, ip)
+		if err != nil {
+			return err
+		}
+		if server.PublicKey != "" {
+			if verifyResp.PublicKey != server.PublicKey {
+				return fmt.Errorf("server %s returned a public key (%s) that does not match server.json (%s)",
+					server.URL, serverKeyFingerprint(verifyResp.PublicKey), serverKeyFingerprint(server.PublicKey))
+			}
+			if err := state.pinServerKey(server.URL, server.PublicKey); err != nil {
+				fmt.Printf("Error saving client state: %v\n", err)
+			}
+		} else if err := state.checkServerKey(server.URL, verifyResp); err != nil {
+			return err
+		}
+		fmt.Printf("Verification successful, server public key received\n")
+
+		step = stepRegister
+		updated, err = registerWithServer(server.URL, config, ip, verifyResp.PublicKey)
+		return err
+	})
 	if err != nil {
-		fmt.Printf("Error getting server info: %v\n", err)
-		return
+		fail(classifyCycleError(step, err), step, err)
+
+		var serverErr *serverError
+		if errors.As(err, &serverErr) && serverErr.Retryable {
+			retryAfter := serverErr.RetryAfter
+			if retryAfter <= 0 {
+				retryAfter = defaultClientRetryAfter
+			}
+			if retryAfter > maxClientRetryAfter {
+				retryAfter = maxClientRetryAfter
+			}
+			fmt.Printf("Server reported a temporary DNS provider failure, retrying in %s\n", retryAfter)
+			result.RetryAfter = retryAfter
+		}
+		return result
+	}
+	fmt.Printf("Registration successful\n")
+
+	result.Outcome = cycleUnchanged
+	if updated {
+		result.Outcome = cycleUpdated
+	}
+
+	if err := state.recordSuccess(profileStateKey(config), ip, time.Now().Add(forceRefreshInterval(config))); err != nil {
+		fmt.Printf("Error saving client state: %v\n", err)
+	}
+	return result
+}
+
+// classifyCycleError maps a failed server exchange to a cycle outcome.
+func classifyCycleError(step string, err error) string {
+	var serverErr *serverError
+	if !errors.As(err, &serverErr) {
+		var netErr net.Error
+		if step == stepFindServer || errors.As(err, &netErr) {
+			return cycleUnreachable
+		}
+		return cycleFailed
 	}
-	fmt.Printf("Server: %s\n", serverInfo.Server)
 
-	verifyResp, err := verifyWithServer(serverInfo.Server, config, ip)
+	switch {
+	case serverErr.Status == http.StatusUnauthorized || serverErr.Status == http.StatusForbidden:
+		return cycleUnauthorized
+	case step == stepRegister && serverErr.Status >= 500:
+		return cycleDNSFailed
+	case serverErr.Status >= 500:
+		return cycleUnreachable
+	}
+	return cycleFailed
+}
+
+// trustServerKey accepts server keys that were refused because they did not
+// match the pinned key.
+func trustServerKey(fingerprint string) {
+	state, err := loadClientState()
 	if err != nil {
-		fmt.Printf("Error verifying with server: %v\n", err)
+		fmt.Printf("Error loading client state: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(state.PendingServerKeys) == 0 {
+		fmt.Println("No changed server key is waiting to be trusted")
 		return
 	}
-	fmt.Printf("Verification successful, server public key received\n")
 
-	err = registerWithServer(serverInfo.Server, config, ip, verifyResp.PublicKey)
+	trusted, err := state.trustPendingKeys(fingerprint)
 	if err != nil {
-		fmt.Printf("Error registering with server: %v\n", err)
-		return
+		fmt.Printf("Error saving client state: %v\n", err)
+		os.Exit(1)
+	}
+	if len(trusted) == 0 {
+		fmt.Printf("No server presented the key %s. Pending keys:\n", fingerprint)
+		for serverURL, pending := range state.PendingServerKeys {
+			fmt.Printf("  %s  %s\n", pending, serverURL)
+		}
+		os.Exit(1)
+	}
+	for _, serverURL := range trusted {
+		fmt.Printf("Trusted the new key %s for %s\n", state.ServerKeys[serverURL], serverURL)
 	}
-	fmt.Printf("Registration successful\n")
-	lastIP = ip
 }
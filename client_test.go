@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestClientState(t *testing.T) *clientState {
+	t.Helper()
+	t.Setenv("VOZDNS_STATE_DIR", t.TempDir())
+	state, err := loadClientState()
+	if err != nil {
+		t.Fatalf("loadClientState: %v", err)
+	}
+	return state
+}
+
+// unregisterServer accepts /unregister for the given clients, checking each
+// signature, and refuses every other domain.
+type unregisterServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	payloads []SignedPayload
+}
+
+func newUnregisterServer(t *testing.T, clients ...*ClientConfig) *unregisterServer {
+	t.Helper()
+	keys := make(map[string]string)
+	for _, client := range clients {
+		keys[client.Domain] = client.PublicKey
+	}
+
+	us := &unregisterServer{}
+	us.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var signedReq SignedRequest
+		json.NewDecoder(r.Body).Decode(&signedReq)
+		data, _ := base64.StdEncoding.DecodeString(signedReq.Data)
+		var payload SignedPayload
+		json.Unmarshal(data, &payload)
+
+		us.mu.Lock()
+		us.payloads = append(us.payloads, payload)
+		us.mu.Unlock()
+
+		publicKey, err := decodePublicKey(keys[payload.Domain])
+		if r.URL.Path != "/unregister" || err != nil || !verifySignature(data, signedReq.Signature, publicKey) {
+			http.Error(w, `{"error": "Domain not authorized"}`, http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"status": "success"}`))
+	}))
+	t.Cleanup(us.Server.Close)
+	return us
+}
+
+func TestUnregisterProfiles(t *testing.T) {
+	home := newTestClient(t, "home.vozdns.vn")
+	revoked := newTestClient(t, "revoked.vozdns.vn")
+	server := newUnregisterServer(t, home)
+
+	homeV6 := *home
+	homeV6.IPFamily = "ipv6"
+	profiles := []*ClientConfig{home, &homeV6, revoked}
+	for _, profile := range profiles {
+		profile.Servers = []string{server.URL}
+	}
+
+	state := newTestClientState(t)
+	next := time.Now().Add(time.Hour)
+	state.recordSuccess(profileStateKey(home), "1.1.1.1", next)
+	state.recordSuccess(profileStateKey(&homeV6), "2606:4700::1111", next)
+	state.recordSuccess(profileStateKey(revoked), "8.8.8.8", next)
+
+	if unregisterProfiles(profiles, state) {
+		t.Error("unregisterProfiles reported success with a refused domain")
+	}
+
+	if len(server.payloads) != 2 {
+		t.Fatalf("got %d requests, want one per domain: %+v", len(server.payloads), server.payloads)
+	}
+	for i, domain := range []string{"home.vozdns.vn", "revoked.vozdns.vn"} {
+		payload := server.payloads[i]
+		if payload.Action != "unregister" || payload.Domain != domain || payload.Timestamp == 0 {
+			t.Errorf("request %d = %+v, want a signed unregister of %s", i, payload, domain)
+		}
+	}
+
+	if ip := state.lastIP(profileStateKey(home), "ipv4"); ip != "" {
+		t.Errorf("IPv4 profile still remembers %s", ip)
+	}
+	if ip := state.lastIP(profileStateKey(&homeV6), "ipv6"); ip != "" {
+		t.Errorf("IPv6 profile still remembers %s", ip)
+	}
+	if !state.nextRefresh(profileStateKey(home)).IsZero() {
+		t.Error("NextRefresh was not cleared")
+	}
+	if ip := state.lastIP(profileStateKey(revoked), "ipv4"); ip != "8.8.8.8" {
+		t.Errorf("failed profile's IP = %q, want it kept", ip)
+	}
+
+	reloaded, err := loadClientState()
+	if err != nil {
+		t.Fatalf("loadClientState: %v", err)
+	}
+	if ip := reloaded.lastIP(profileStateKey(home), "ipv4"); ip != "" {
+		t.Errorf("saved state still remembers %s", ip)
+	}
+}
+
+// stubProfileCycle replaces the client cycle for the rest of the test. Every
+// call is reported on the returned channel and answered by result.
+func stubProfileCycle(t *testing.T, result func(call int) *cycleResult) <-chan int {
+	t.Helper()
+	calls := make(chan int, 100)
+	count := 0
+	previous := profileCycle
+	profileCycle = func(config *ClientConfig, state *clientState) *cycleResult {
+		count++
+		r := result(count)
+		calls <- count
+		return r
+	}
+	t.Cleanup(func() { profileCycle = previous })
+	return calls
+}
+
+// startProfile runs runProfile until the test ends.
+func startProfile(t *testing.T, config *ClientConfig, state *clientState, changes <-chan struct{}) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runProfile(ctx, config, state, changes)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func waitCall(t *testing.T, calls <-chan int, want int) {
+	t.Helper()
+	select {
+	case call := <-calls:
+		if call != want {
+			t.Fatalf("got call %d, want %d", call, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("call %d did not happen", want)
+	}
+}
+
+func expectNoCall(t *testing.T, calls <-chan int, wait time.Duration) {
+	t.Helper()
+	select {
+	case call := <-calls:
+		t.Fatalf("unexpected call %d", call)
+	case <-time.After(wait):
+	}
+}
+
+func TestRunProfileDebouncesNetworkChanges(t *testing.T) {
+	previous := networkChangeDebounce
+	networkChangeDebounce = 50 * time.Millisecond
+	t.Cleanup(func() { networkChangeDebounce = previous })
+
+	calls := stubProfileCycle(t, func(int) *cycleResult { return &cycleResult{Outcome: cycleUnchanged} })
+	changes := make(chan struct{})
+	config := &ClientConfig{Domain: "home.vozdns.vn", CheckInterval: Duration(time.Hour)}
+	startProfile(t, config, newTestClientState(t), changes)
+
+	waitCall(t, calls, 1)
+
+	// A burst of changes, e.g. a PPPoE reconnect, leads to a single check
+	// once it has settled.
+	var last time.Time
+	for i := 0; i < 3; i++ {
+		changes <- struct{}{}
+		last = time.Now()
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitCall(t, calls, 2)
+	if waited := time.Since(last); waited < networkChangeDebounce {
+		t.Errorf("check ran %s after the last change, want at least %s", waited, networkChangeDebounce)
+	}
+	expectNoCall(t, calls, 200*time.Millisecond)
+}
+
+func TestWatchProfileNetworks(t *testing.T) {
+	events := make(chan struct{})
+	watchers := 0
+	previous := networkWatcher
+	networkWatcher = func(ctx context.Context) (<-chan struct{}, error) {
+		watchers++
+		return events, nil
+	}
+	t.Cleanup(func() { networkWatcher = previous })
+
+	disabled := true
+	profiles := []*ClientConfig{
+		{Domain: "home.vozdns.vn"},
+		{Domain: "nas.vozdns.vn", DisableNetworkWatch: &disabled},
+		{Domain: "home.vozdns.vn", IPFamily: "ipv6"},
+	}
+	changes := watchProfileNetworks(context.Background(), profiles)
+
+	if watchers != 1 {
+		t.Fatalf("started %d watchers, want one for every profile", watchers)
+	}
+	if changes[1] != nil {
+		t.Error("profile with disable_network_watch gets network changes")
+	}
+
+	events <- struct{}{}
+	for _, i := range []int{0, 2} {
+		select {
+		case <-changes[i]:
+		case <-time.After(2 * time.Second):
+			t.Errorf("profile %d was not notified", i)
+		}
+	}
+
+	if watchProfileNetworks(context.Background(), profiles[1:2]); watchers != 1 {
+		t.Error("started a watcher although no profile uses it")
+	}
+}
+
+func TestWatchProfileNetworksUnsupported(t *testing.T) {
+	previous := networkWatcher
+	networkWatcher = func(ctx context.Context) (<-chan struct{}, error) {
+		return nil, errors.New("not supported")
+	}
+	t.Cleanup(func() { networkWatcher = previous })
+
+	calls := stubProfileCycle(t, func(int) *cycleResult { return &cycleResult{Outcome: cycleUnchanged} })
+	config := &ClientConfig{Domain: "home.vozdns.vn", CheckInterval: Duration(50 * time.Millisecond)}
+	changes := watchProfileNetworks(context.Background(), []*ClientConfig{config})
+
+	// Without a watcher the profile still runs on its timer.
+	startProfile(t, config, newTestClientState(t), changes[0])
+	waitCall(t, calls, 1)
+	waitCall(t, calls, 2)
+}
+
+func TestNextCheckDelay(t *testing.T) {
+	if got := nextCheckDelay(&ClientConfig{}); got != defaultCheckInterval {
+		t.Errorf("default delay = %s, want %s", got, defaultCheckInterval)
+	}
+	if got := nextCheckDelay(&ClientConfig{CheckInterval: Duration(5 * time.Minute)}); got != 5*time.Minute {
+		t.Errorf("delay = %s, want 5m", got)
+	}
+
+	config := &ClientConfig{CheckInterval: Duration(5 * time.Minute), Jitter: Duration(time.Minute)}
+	spread := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		got := nextCheckDelay(config)
+		if got < 5*time.Minute || got >= 6*time.Minute {
+			t.Fatalf("delay with jitter = %s, want within [5m, 6m)", got)
+		}
+		spread[got] = true
+	}
+	if len(spread) < 2 {
+		t.Error("jitter did not change the delay")
+	}
+}
+
+func TestForceRefreshInterval(t *testing.T) {
+	if got := forceRefreshInterval(&ClientConfig{}); got != defaultForceRefresh {
+		t.Errorf("default = %s, want %s", got, defaultForceRefresh)
+	}
+	if got := forceRefreshInterval(&ClientConfig{ForceRefresh: Duration(time.Hour)}); got != time.Hour {
+		t.Errorf("force_refresh = %s, want 1h", got)
+	}
+}
+
+func TestRunClientCycleForceRefresh(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	config := &ClientConfig{
+		Domain:    "home.vozdns.vn",
+		IPSources: []IPSource{ipSourceServer(t, "1.1.1.1")},
+		Servers:   []string{server.URL},
+	}
+	state := newTestClientState(t)
+	key := profileStateKey(config)
+
+	// The same IP before NextRefresh is not sent to the server.
+	state.recordSuccess(key, "1.1.1.1", time.Now().Add(time.Hour))
+	if result := runClientCycle(config, state); result.Outcome != cycleUnchanged {
+		t.Errorf("outcome = %s, want %s", result.Outcome, cycleUnchanged)
+	}
+	if requests != 0 {
+		t.Errorf("server got %d requests for an unchanged IP", requests)
+	}
+	if state.snapshot(key).LastCheck.IsZero() {
+		t.Error("unchanged cycle did not record the check")
+	}
+
+	// Once NextRefresh has passed, it is registered again.
+	state.recordSuccess(key, "1.1.1.1", time.Now().Add(-time.Minute))
+	if result := runClientCycle(config, state); result.Outcome == cycleUnchanged {
+		t.Error("forced refresh was skipped")
+	}
+	if requests == 0 {
+		t.Error("forced refresh did not contact the server")
+	}
+}
+
+func TestRunProfileTimer(t *testing.T) {
+	calls := stubProfileCycle(t, func(int) *cycleResult { return &cycleResult{Outcome: cycleUnchanged} })
+	config := &ClientConfig{Domain: "home.vozdns.vn", CheckInterval: Duration(50 * time.Millisecond)}
+	state := newTestClientState(t)
+	startProfile(t, config, state, nil)
+
+	for call := 1; call <= 3; call++ {
+		waitCall(t, calls, call)
+	}
+	next := state.snapshot(profileStateKey(config)).NextCheck
+	if next.IsZero() || time.Until(next) > time.Second {
+		t.Errorf("NextCheck = %s, want within check_interval", next)
+	}
+}
+
+func TestRunProfileRetryAfter(t *testing.T) {
+	config := &ClientConfig{Domain: "home.vozdns.vn", CheckInterval: Duration(time.Hour)}
+	state := newTestClientState(t)
+
+	var nextCheck time.Time
+	calls := stubProfileCycle(t, func(call int) *cycleResult {
+		if call == 1 {
+			return &cycleResult{Outcome: cycleDNSFailed, RetryAfter: 50 * time.Millisecond}
+		}
+		nextCheck = state.snapshot(profileStateKey(config)).NextCheck
+		return &cycleResult{Outcome: cycleUpdated}
+	})
+	startProfile(t, config, state, nil)
+
+	// The server's Retry-After wins over the hour-long interval, and
+	// NextCheck reports the earlier run.
+	waitCall(t, calls, 1)
+	waitCall(t, calls, 2)
+	if time.Until(nextCheck) > time.Second {
+		t.Errorf("NextCheck after a retryable failure = %s, want the retry", nextCheck)
+	}
+	expectNoCall(t, calls, 200*time.Millisecond)
+	if next := state.snapshot(profileStateKey(config)).NextCheck; time.Until(next) < 50*time.Minute {
+		t.Errorf("NextCheck after success = %s, want check_interval away", next)
+	}
+}
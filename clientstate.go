@@ -0,0 +1,356 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const clientStateFileName = "state.json"
+
+// domainState is what the client remembers about one domain between runs.
+type domainState struct {
+	LastIPs     map[string]string `json:"last_ips,omitempty"`
+	LastChange  time.Time         `json:"last_change"`
+	LastSuccess time.Time         `json:"last_success"`
+	LastFailure time.Time         `json:"last_failure"`
+	LastError   string            `json:"last_error,omitempty"`
+	NextRefresh time.Time         `json:"next_refresh"`
+
+	// Only kept while the client runs, for the health endpoints.
+	LastCheck time.Time `json:"-"`
+	NextCheck time.Time `json:"-"`
+}
+
+// clientState is persisted in the state dir so a restarted client does not
+// register an unchanged IP again and keeps the history of IP changes.
+type clientState struct {
+	mu   sync.Mutex
+	path string
+
+	// ServerKeys pins the key fingerprint of each server URL on first use.
+	// A changed key that could not be verified waits in PendingServerKeys
+	// until the user runs -trust-server-key.
+	ServerKeys        map[string]string       `json:"server_keys,omitempty"`
+	PendingServerKeys map[string]string       `json:"pending_server_keys,omitempty"`
+	Domains           map[string]*domainState `json:"domains"`
+}
+
+func loadClientState() (*clientState, error) {
+	stateDir, err := getStateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(stateDir, clientStateFileName)
+	state := &clientState{path: path, Domains: make(map[string]*domainState)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+	if state.Domains == nil {
+		state.Domains = make(map[string]*domainState)
+	}
+
+	return state, nil
+}
+
+// domain must be called with s.mu held.
+func (s *clientState) domain(name string) *domainState {
+	name = normalizeRecordName(name)
+	if s.Domains[name] == nil {
+		s.Domains[name] = &domainState{}
+	}
+	return s.Domains[name]
+}
+
+func (s *clientState) lastIP(name, family string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.domain(name).LastIPs[family]
+}
+
+func (s *clientState) nextRefresh(name string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.domain(name).NextRefresh
+}
+
+func (s *clientState) recordSuccess(name, ip string, nextRefresh time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	domain := s.domain(name)
+	family := ipFamily(ip)
+	if domain.LastIPs == nil {
+		domain.LastIPs = make(map[string]string)
+	}
+	if domain.LastIPs[family] != ip {
+		domain.LastIPs[family] = ip
+		domain.LastChange = time.Now().UTC()
+	}
+	domain.LastSuccess = time.Now().UTC()
+	domain.LastCheck = domain.LastSuccess
+	domain.LastError = ""
+	domain.NextRefresh = nextRefresh.UTC()
+	return s.save()
+}
+
+// recordCheck notes a cycle that found nothing to update.
+func (s *clientState) recordCheck(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.domain(name).LastCheck = time.Now().UTC()
+}
+
+func (s *clientState) setNextCheck(name string, next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.domain(name).NextCheck = next.UTC()
+}
+
+// snapshot returns a copy of what is known about a domain.
+func (s *clientState) snapshot(name string) domainState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	domain := *s.domain(name)
+	domain.LastIPs = make(map[string]string)
+	for family, ip := range s.domain(name).LastIPs {
+		domain.LastIPs[family] = ip
+	}
+	return domain
+}
+
+func (s *clientState) recordFailure(name string, err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	domain := s.domain(name)
+	domain.LastFailure = time.Now().UTC()
+	domain.LastError = err.Error()
+	return s.save()
+}
+
+// pinServerKey pins a key that is already trusted, e.g. because it is
+// listed in the signed server.json.
+func (s *clientState) pinServerKey(serverURL, publicKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fingerprint := serverKeyFingerprint(publicKey)
+	if s.ServerKeys[serverURL] == fingerprint && s.PendingServerKeys[serverURL] == "" {
+		return nil
+	}
+	if s.ServerKeys == nil {
+		s.ServerKeys = make(map[string]string)
+	}
+	// The key is trusted either way; if it cannot be saved it is pinned for
+	// this run only and pinned again on the next start.
+	s.ServerKeys[serverURL] = fingerprint
+	delete(s.PendingServerKeys, serverURL)
+	if err := s.save(); err != nil {
+		fmt.Printf("Warning: failed to save the pinned server key, it is only pinned until the client restarts: %v\n", err)
+	}
+	return nil
+}
+
+// checkServerKey accepts the key a server returned from /verify if it is
+// the pinned one, the first one seen for that server, or a rotation signed
+// by the pinned key. Any other key is refused and kept as pending.
+func (s *clientState) checkServerKey(serverURL string, verifyResp *VerifyResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fingerprint := serverKeyFingerprint(verifyResp.PublicKey)
+	pinned := s.ServerKeys[serverURL]
+	if pinned == fingerprint {
+		return nil
+	}
+
+	if s.ServerKeys == nil {
+		s.ServerKeys = make(map[string]string)
+	}
+
+	switch {
+	case pinned == "":
+		fmt.Printf("Pinned server key %s for %s (first use)\n", fingerprint, serverURL)
+	case s.trustedOnDisk(serverURL, fingerprint):
+		fmt.Printf("Using server key %s for %s (trusted with -trust-server-key)\n", fingerprint, serverURL)
+	case verifiedKeyRotation(pinned, verifyResp):
+		fmt.Printf("Server %s rotated its key from %s to %s (signed by the old key)\n", serverURL, pinned, fingerprint)
+	default:
+		if s.PendingServerKeys == nil {
+			s.PendingServerKeys = make(map[string]string)
+		}
+		if s.PendingServerKeys[serverURL] != fingerprint {
+			s.PendingServerKeys[serverURL] = fingerprint
+			if err := s.save(); err != nil {
+				fmt.Printf("Error saving client state: %v\n", err)
+			}
+		}
+
+		fmt.Println("!!! WARNING: SERVER KEY MISMATCH !!!")
+		fmt.Printf("!!! Server:   %s\n", serverURL)
+		fmt.Printf("!!! Pinned:   %s\n", pinned)
+		fmt.Printf("!!! Received: %s\n", fingerprint)
+		fmt.Println("!!! The key changed without a signature from the pinned key. Someone may be")
+		fmt.Println("!!! impersonating the server. No update is sent to it. If you know the key")
+		fmt.Println("!!! change is legitimate, run: vozdns -trust-server-key " + fingerprint)
+		return fmt.Errorf("server %s key %s does not match the pinned key %s", serverURL, fingerprint, pinned)
+	}
+
+	// The key is trusted either way; if it cannot be saved it is pinned for
+	// this run only and pinned again on the next start.
+	s.ServerKeys[serverURL] = fingerprint
+	delete(s.PendingServerKeys, serverURL)
+	if err := s.save(); err != nil {
+		fmt.Printf("Warning: failed to save the pinned server key, it is only pinned until the client restarts: %v\n", err)
+	}
+	return nil
+}
+
+// trustedOnDisk reports whether -trust-server-key pinned fingerprint for
+// serverURL in the state file since this client loaded it.
+// It must be called with s.mu held.
+func (s *clientState) trustedOnDisk(serverURL, fingerprint string) bool {
+	onDisk, err := s.onDisk()
+	if err != nil {
+		return false
+	}
+	return onDisk.ServerKeys[serverURL] == fingerprint
+}
+
+// onDisk reads the state file as it is now, which another vozdns process
+// may have changed. It must be called with s.mu held.
+func (s *clientState) onDisk() (*clientState, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var onDisk clientState
+	if err := json.Unmarshal(data, &onDisk); err != nil {
+		return nil, err
+	}
+	return &onDisk, nil
+}
+
+// mergeTrustedKeys takes over the pending keys that -trust-server-key pinned
+// in the state file, so that saving does not undo them.
+// It must be called with s.mu held.
+func (s *clientState) mergeTrustedKeys() {
+	if len(s.PendingServerKeys) == 0 {
+		return
+	}
+	onDisk, err := s.onDisk()
+	if err != nil {
+		return
+	}
+	for serverURL, pending := range s.PendingServerKeys {
+		if onDisk.ServerKeys[serverURL] != pending {
+			continue
+		}
+		if s.ServerKeys == nil {
+			s.ServerKeys = make(map[string]string)
+		}
+		s.ServerKeys[serverURL] = pending
+		delete(s.PendingServerKeys, serverURL)
+	}
+}
+
+// trustPendingKeys pins the pending keys, or only the one with fingerprint
+// when it is not empty, and returns the server URLs that were updated.
+func (s *clientState) trustPendingKeys(fingerprint string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var trusted []string
+	for serverURL, pending := range s.PendingServerKeys {
+		if fingerprint != "" && pending != fingerprint {
+			continue
+		}
+		if s.ServerKeys == nil {
+			s.ServerKeys = make(map[string]string)
+		}
+		s.ServerKeys[serverURL] = pending
+		delete(s.PendingServerKeys, serverURL)
+		trusted = append(trusted, serverURL)
+	}
+	if len(trusted) == 0 {
+		return nil, nil
+	}
+	sort.Strings(trusted)
+	return trusted, s.save()
+}
+
+// forget clears the published IPs after the records were removed, so the
+// next run registers again even if the IP is unchanged.
+func (s *clientState) forget(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	domain := s.domain(name)
+	domain.LastIPs = nil
+	domain.NextRefresh = time.Time{}
+	return s.save()
+}
+
+// save must be called with s.mu held.
+func (s *clientState) save() error {
+	s.mergeTrustedKeys()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+// serverKeyFingerprint is the SHA-256 of the server's DER public key.
+func serverKeyFingerprint(publicKey string) string {
+	keyBytes, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		keyBytes = []byte(publicKey)
+	}
+	sum := sha256.Sum256(keyBytes)
+	return "SHA256:" + hex.EncodeToString(sum[:])
+}
+
+// verifiedKeyRotation reports whether verifyResp carries the key with the
+// pinned fingerprint and that key's signature over the new public key.
+func verifiedKeyRotation(pinned string, verifyResp *VerifyResponse) bool {
+	if verifyResp.PreviousPublicKey == "" || verifyResp.KeySignature == "" {
+		return false
+	}
+	if serverKeyFingerprint(verifyResp.PreviousPublicKey) != pinned {
+		return false
+	}
+	previousKey, err := decodePublicKey(verifyResp.PreviousPublicKey)
+	if err != nil {
+		return false
+	}
+	return verifySignature([]byte(verifyResp.PublicKey), verifyResp.KeySignature, previousKey)
+}
+
+func ipFamily(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "ipv6"
+	}
+	return "ipv4"
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadClientStateUsesStateDir(t *testing.T) {
+	home := t.TempDir()
+	stateDir := filepath.Join(t.TempDir(), "state")
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("VOZDNS_STATE_DIR", stateDir)
+
+	state, err := loadClientState()
+	if err != nil {
+		t.Fatalf("loadClientState: %v", err)
+	}
+	if err := state.recordFailure("home.vozdns.vn", os.ErrDeadlineExceeded); err != nil {
+		t.Fatalf("recordFailure: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(stateDir, clientStateFileName)); err != nil {
+		t.Errorf("state was not written to the state dir: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(home, ".vozdns", clientStateFileName)); !os.IsNotExist(err) {
+		t.Errorf("state was written to the config dir")
+	}
+}
+
+// testServerKeys returns two server key pairs as the server would encode them
+// and a VerifyResponse for the second one that rotates from the first.
+func testServerKeys(t *testing.T) (string, string, *VerifyResponse) {
+	t.Helper()
+	oldPrivate, oldPublic, err := generateECCKeyPair()
+	if err != nil {
+		t.Fatalf("generateECCKeyPair: %v", err)
+	}
+	_, newPublic, err := generateECCKeyPair()
+	if err != nil {
+		t.Fatalf("generateECCKeyPair: %v", err)
+	}
+	oldKey, _ := encodePublicKey(oldPublic)
+	newKey, _ := encodePublicKey(newPublic)
+
+	signature, err := signData([]byte(newKey), oldPrivate)
+	if err != nil {
+		t.Fatalf("signData: %v", err)
+	}
+	return oldKey, newKey, &VerifyResponse{PublicKey: newKey, PreviousPublicKey: oldKey, KeySignature: signature}
+}
+
+func TestVerifiedKeyRotation(t *testing.T) {
+	oldKey, newKey, rotation := testServerKeys(t)
+	_, otherKey, _ := testServerKeys(t)
+
+	tests := []struct {
+		name   string
+		pinned string
+		resp   VerifyResponse
+		want   bool
+	}{
+		{name: "signed by the pinned key", pinned: serverKeyFingerprint(oldKey), resp: *rotation, want: true},
+		{name: "pinned a different key", pinned: serverKeyFingerprint(otherKey), resp: *rotation},
+		{name: "no rotation", pinned: serverKeyFingerprint(oldKey), resp: VerifyResponse{PublicKey: newKey}},
+		{
+			name:   "signature over another key",
+			pinned: serverKeyFingerprint(oldKey),
+			resp:   VerifyResponse{PublicKey: otherKey, PreviousPublicKey: oldKey, KeySignature: rotation.KeySignature},
+		},
+		{
+			name:   "bad signature",
+			pinned: serverKeyFingerprint(oldKey),
+			resp:   VerifyResponse{PublicKey: newKey, PreviousPublicKey: oldKey, KeySignature: "bm90IGEgc2lnbmF0dXJl"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := verifiedKeyRotation(test.pinned, &test.resp); got != test.want {
+				t.Errorf("verifiedKeyRotation = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckServerKey(t *testing.T) {
+	oldKey, newKey, rotation := testServerKeys(t)
+	_, otherKey, _ := testServerKeys(t)
+	const server = "https://a.vozdns.vn"
+
+	state := &clientState{path: filepath.Join(t.TempDir(), clientStateFileName), Domains: make(map[string]*domainState)}
+
+	if err := state.checkServerKey(server, &VerifyResponse{PublicKey: oldKey}); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := state.checkServerKey(server, &VerifyResponse{PublicKey: oldKey}); err != nil {
+		t.Fatalf("pinned key: %v", err)
+	}
+	if err := state.checkServerKey(server, &VerifyResponse{PublicKey: otherKey}); err == nil {
+		t.Fatal("accepted a different key")
+	}
+	if state.PendingServerKeys[server] != serverKeyFingerprint(otherKey) {
+		t.Errorf("refused key not kept for -trust-server-key")
+	}
+	if err := state.checkServerKey(server, rotation); err != nil {
+		t.Fatalf("signed rotation: %v", err)
+	}
+	if state.ServerKeys[server] != serverKeyFingerprint(newKey) || state.PendingServerKeys[server] != "" {
+		t.Errorf("rotation not pinned: %+v", state.ServerKeys)
+	}
+}
+
+func TestCheckServerKeyUnwritableState(t *testing.T) {
+	oldKey, _, _ := testServerKeys(t)
+	state := &clientState{path: filepath.Join(t.TempDir(), "missing", clientStateFileName), Domains: make(map[string]*domainState)}
+
+	if err := state.checkServerKey("https://a.vozdns.vn", &VerifyResponse{PublicKey: oldKey}); err != nil {
+		t.Fatalf("first use failed when the state could not be saved: %v", err)
+	}
+	if state.ServerKeys["https://a.vozdns.vn"] != serverKeyFingerprint(oldKey) {
+		t.Error("key not pinned in memory")
+	}
+}
+
+func TestTrustedKeySurvivesSave(t *testing.T) {
+	oldKey, newKey, _ := testServerKeys(t)
+	const server = "https://a.vozdns.vn"
+	path := filepath.Join(t.TempDir(), clientStateFileName)
+
+	running := &clientState{path: path, Domains: make(map[string]*domainState)}
+	if err := running.checkServerKey(server, &VerifyResponse{PublicKey: oldKey}); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := running.checkServerKey(server, &VerifyResponse{PublicKey: newKey}); err == nil {
+		t.Fatal("accepted a different key")
+	}
+
+	// -trust-server-key runs in another process while the client is running.
+	t.Setenv("VOZDNS_STATE_DIR", filepath.Dir(path))
+	other, err := loadClientState()
+	if err != nil {
+		t.Fatalf("loadClientState: %v", err)
+	}
+	if trusted, err := other.trustPendingKeys(""); err != nil || len(trusted) != 1 {
+		t.Fatalf("trustPendingKeys = %v, %v", trusted, err)
+	}
+
+	// The running client saves its state before it talks to the server again.
+	if err := running.recordFailure("home.vozdns.vn", os.ErrDeadlineExceeded); err != nil {
+		t.Fatalf("recordFailure: %v", err)
+	}
+	saved, err := loadClientState()
+	if err != nil {
+		t.Fatalf("loadClientState: %v", err)
+	}
+	if saved.ServerKeys[server] != serverKeyFingerprint(newKey) || len(saved.PendingServerKeys) != 0 {
+		t.Errorf("save undid -trust-server-key: keys %v, pending %v", saved.ServerKeys, saved.PendingServerKeys)
+	}
+
+	if err := running.checkServerKey(server, &VerifyResponse{PublicKey: newKey}); err != nil {
+		t.Fatalf("trusted key refused: %v", err)
+	}
+}
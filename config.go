@@ -6,6 +6,8 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"time"
 )
 
 func getConfigDir() (string, error) {
@@ -31,6 +33,21 @@ func getConfigDir() (string, error) {
 	return configDir, nil
 }
 
+// getStateDir returns where the client keeps state.json: $VOZDNS_STATE_DIR
+// when set, so the config can be mounted read-only, or else the config dir.
+func getStateDir() (string, error) {
+	stateDir := os.Getenv("VOZDNS_STATE_DIR")
+	if stateDir == "" {
+		return getConfigDir()
+	}
+
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	return stateDir, nil
+}
+
 func generateClientConfig(domain string) {
 	fmt.Printf("Generating client config for domain: %s\n", domain)
 
@@ -65,7 +82,22 @@ func generateClientConfig(domain string) {
 		return
 	}
 
+	// An existing config.json keeps its keys, the new domain becomes an
+	// extra profile in domains.d instead.
 	configPath := filepath.Join(configDir, "config.json")
+	if _, err := os.Stat(configPath); err == nil {
+		profileDir := filepath.Join(configDir, clientProfileDir)
+		if err := os.MkdirAll(profileDir, 0700); err != nil {
+			fmt.Printf("Error creating %s: %v\n", profileDir, err)
+			return
+		}
+		configPath = filepath.Join(profileDir, domain+".json")
+		if _, err := os.Stat(configPath); err == nil {
+			fmt.Printf("A profile for %s already exists at %s\n", domain, configPath)
+			return
+		}
+	}
+
 	configData, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		fmt.Printf("Error marshaling config: %v\n", err)
@@ -107,9 +139,23 @@ func generateServerConfig() {
 		PrivateKey: privateKeyStr,
 		PublicKey:  publicKeyStr,
 		Listen:     ":8080",
-		AuthEmail:  "(The email used to login 'https://dash.cloudflare.com')",
-		AuthKey:    "(Your API Token)",
-		ZoneID:     "(Can be found in the \"Overview\" tab of your domain)",
+		ZoneConfig: ZoneConfig{
+			Provider:  "dryrun",
+			AuthType:  "token",
+			AuthEmail: "(Only for auth_type \"global_key\": the email used to login 'https://dash.cloudflare.com')",
+			AuthKey:   "(Your API Token)",
+			ZoneID:    "(Can be found in the \"Overview\" tab of your domain)",
+
+			DuplicatePolicy: "delete",
+		},
+		Retry: RetryConfig{}.withDefaults(),
+
+		StateFile:          defaultServerStateFile,
+		DriftCheckInterval: Duration(15 * time.Minute),
+		DriftPolicy:        "report",
+
+		OrphanCheckInterval: Duration(time.Hour),
+		OrphanPolicy:        "report",
 	}
 
 	configPath := "./config.json"
@@ -126,7 +172,10 @@ func generateServerConfig() {
 	}
 
 	fmt.Printf("Server config generated successfully at: %s\n", configPath)
-	fmt.Println("Please edit the config file and update the Cloudflare credentials.")
+	fmt.Println("The server starts with the \"dryrun\" provider, which only logs DNS changes.")
+	fmt.Println("Please edit the config file, update the Cloudflare credentials and set provider to \"cloudflare\".")
+	fmt.Println("Set auth_type to \"token\" for a scoped API token or \"global_key\" for email + global API key.")
+	fmt.Println("To serve several apex domains, add a \"zones\" map of domain suffix to zone settings.")
 }
 
 func loadClientConfig() (*ClientConfig, error) {
@@ -150,6 +199,130 @@ func loadClientConfig() (*ClientConfig, error) {
 	return &config, nil
 }
 
+const clientProfileDir = "domains.d"
+
+// loadClientProfiles returns one config per domain: the top-level domain of
+// config.json if it has one, each entry of its "domains" array and each file
+// in domains.d. Profiles inherit the IP detection and scheduling settings
+// they leave empty from config.json, but each needs a key pair.
+func loadClientProfiles() ([]*ClientConfig, error) {
+	config, err := loadClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []*ClientConfig
+	if config.Domain != "" {
+		profile := *config
+		profile.Domains = nil
+		profiles = append(profiles, &profile)
+	}
+	for _, profile := range config.Domains {
+		if profile != nil {
+			profiles = append(profiles, profile)
+		}
+	}
+
+	configDir, err := getConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(configDir, clientProfileDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		var profile ClientConfig
+		if err := json.Unmarshal(data, &profile); err != nil {
+			return nil, fmt.Errorf("invalid profile %s: %v", file, err)
+		}
+		profiles = append(profiles, &profile)
+	}
+
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("no domains configured. Run './vozdns -generate -domain <domain>' first")
+	}
+
+	// A domain may have one profile per IP family, so a dual-stack host
+	// publishes both its A and its AAAA record.
+	seen := make(map[string]bool)
+	for _, profile := range profiles {
+		if profile.Domain == "" || profile.PrivateKey == "" {
+			return nil, fmt.Errorf("every domain profile needs a domain and a key pair")
+		}
+
+		inheritClientDefaults(profile, config)
+
+		key := profileStateKey(profile)
+		if seen[key] {
+			return nil, fmt.Errorf("domain %s (%s) is configured more than once", normalizeRecordName(profile.Domain), profileFamily(profile))
+		}
+		seen[key] = true
+	}
+
+	return profiles, nil
+}
+
+func inheritClientDefaults(profile, defaults *ClientConfig) {
+	if len(profile.IPSources) == 0 {
+		profile.IPSources = defaults.IPSources
+	}
+	if profile.IPStrategy == "" {
+		profile.IPStrategy = defaults.IPStrategy
+	}
+	if profile.IPFamily == "" {
+		profile.IPFamily = defaults.IPFamily
+	}
+	if profile.IPTimeout == 0 {
+		profile.IPTimeout = defaults.IPTimeout
+	}
+	if profile.CheckInterval == 0 {
+		profile.CheckInterval = defaults.CheckInterval
+	}
+	if profile.Jitter == 0 {
+		profile.Jitter = defaults.Jitter
+	}
+	if profile.ForceRefresh == 0 {
+		profile.ForceRefresh = defaults.ForceRefresh
+	}
+	if len(profile.Servers) == 0 {
+		profile.Servers = defaults.Servers
+	}
+	if profile.RemoveOnShutdown == nil {
+		profile.RemoveOnShutdown = defaults.RemoveOnShutdown
+	}
+	if profile.DisableNetworkWatch == nil {
+		profile.DisableNetworkWatch = defaults.DisableNetworkWatch
+	}
+}
+
+// isSet reports whether an optional boolean setting is present and true.
+func isSet(value *bool) bool {
+	return value != nil && *value
+}
+
+func profileFamily(config *ClientConfig) string {
+	if config.IPFamily == "" {
+		return "ipv4"
+	}
+	return config.IPFamily
+}
+
+// profileStateKey names a profile in the client state. IPv4 profiles use the
+// bare domain, as before profiles could differ by family.
+func profileStateKey(config *ClientConfig) string {
+	domain := normalizeRecordName(config.Domain)
+	if family := profileFamily(config); family != "ipv4" {
+		return domain + "/" + family
+	}
+	return domain
+}
+
 func loadServerConfig() (*ServerConfig, error) {
 	configPath := "./config.json"
 	configData, err := os.ReadFile(configPath)
@@ -165,3 +338,33 @@ func loadServerConfig() (*ServerConfig, error) {
 
 	return &config, nil
 }
+
+// Duration is a time.Duration that reads from JSON either as a Go duration
+// string ("90s", "5m") or as a number of seconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %v", v, err)
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", string(data))
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeClientConfig(t *testing.T, config map[string]interface{}) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	dir := filepath.Join(home, ".vozdns")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), data, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func TestLoadClientProfilesDualStack(t *testing.T) {
+	writeClientConfig(t, map[string]interface{}{
+		"privatekey": "key", "domain": "home.vozdns.vn",
+		"domains": []map[string]interface{}{
+			{"privatekey": "key", "domain": "home.vozdns.vn", "ip_family": "ipv6"},
+		},
+	})
+
+	profiles, err := loadClientProfiles()
+	if err != nil {
+		t.Fatalf("loadClientProfiles: %v", err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("got %d profiles, want 2", len(profiles))
+	}
+	if profileStateKey(profiles[0]) != "home.vozdns.vn" || profileStateKey(profiles[1]) != "home.vozdns.vn/ipv6" {
+		t.Errorf("state keys = %s, %s", profileStateKey(profiles[0]), profileStateKey(profiles[1]))
+	}
+}
+
+func TestLoadClientProfilesRejectsDuplicates(t *testing.T) {
+	writeClientConfig(t, map[string]interface{}{
+		"privatekey": "key", "domain": "home.vozdns.vn", "ip_family": "ipv6",
+		"domains": []map[string]interface{}{
+			{"privatekey": "key", "domain": "Home.vozdns.vn."},
+		},
+	})
+
+	_, err := loadClientProfiles()
+	if err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Fatalf("err = %v, want a duplicate error", err)
+	}
+}
+
+func TestInheritClientDefaultsOptionalBools(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name     string
+		profile  *bool
+		defaults *bool
+		want     bool
+	}{
+		{name: "unset everywhere", want: false},
+		{name: "inherited", defaults: &yes, want: true},
+		{name: "opted out", profile: &no, defaults: &yes, want: false},
+		{name: "opted in", profile: &yes, defaults: &no, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile := &ClientConfig{RemoveOnShutdown: test.profile, DisableNetworkWatch: test.profile}
+			defaults := &ClientConfig{RemoveOnShutdown: test.defaults, DisableNetworkWatch: test.defaults}
+			inheritClientDefaults(profile, defaults)
+
+			if isSet(profile.RemoveOnShutdown) != test.want {
+				t.Errorf("remove_on_shutdown = %v, want %v", isSet(profile.RemoveOnShutdown), test.want)
+			}
+			if isSet(profile.DisableNetworkWatch) != test.want {
+				t.Errorf("disable_network_watch = %v, want %v", isSet(profile.DisableNetworkWatch), test.want)
+			}
+		})
+	}
+}
@@ -159,3 +159,21 @@ func decryptWithPrivateKey(encryptedData string, privateKey *ecdsa.PrivateKey) (
 
 	return plaintext, nil
 }
+
+func signData(data []byte, privateKey *ecdsa.PrivateKey) (string, error) {
+	hash := sha256.Sum256(data)
+	signature, err := ecdsa.SignASN1(rand.Reader, privateKey, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+func verifySignature(data []byte, signature string, publicKey *ecdsa.PublicKey) bool {
+	signatureBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256(data)
+	return ecdsa.VerifyASN1(publicKey, hash[:], signatureBytes)
+}
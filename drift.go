@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type driftReport struct {
+	Domain   string   `json:"domain"`
+	Type     string   `json:"type"`
+	Expected string   `json:"expected"`
+	Actual   []string `json:"actual"`
+	Repaired bool     `json:"repaired"`
+	Error    string   `json:"error,omitempty"`
+}
+
+type driftResult struct {
+	CheckedAt time.Time     `json:"checked_at"`
+	Checked   int           `json:"checked"`
+	Drift     []driftReport `json:"drift"`
+}
+
+// driftDetector compares the provider's records with what clients last
+// registered and, depending on policy, repairs or only reports differences
+// such as a record edited by hand in the provider's dashboard.
+type driftDetector struct {
+	config *ServerConfig
+	zones  *zoneRegistry
+	state  *serverState
+
+	mu   sync.Mutex
+	last *driftResult
+}
+
+func newDriftDetector(config *ServerConfig, zones *zoneRegistry, state *serverState) *driftDetector {
+	return &driftDetector{config: config, zones: zones, state: state}
+}
+
+func (d *driftDetector) check() *driftResult {
+	result := &driftResult{CheckedAt: time.Now().UTC(), Drift: []driftReport{}}
+
+	// Repairing a name that was revoked would hand it back to its old owner,
+	// so nothing is repaired unless the registry can be checked.
+	authorized, err := authorizedNames()
+	if err != nil {
+		fmt.Printf("Drift check cannot verify authorized domains, not repairing: %v\n", err)
+	}
+
+	for _, registered := range d.state.list() {
+		if authorized != nil && !authorized[registered.Domain] {
+			fmt.Printf("Dropping %s %s from server state: domain is no longer authorized\n", registered.Domain, registered.Type)
+			if err := d.state.removeRecord(registered.Domain, registered.Type); err != nil {
+				fmt.Printf("Error saving server state: %v\n", err)
+			}
+			continue
+		}
+		result.Checked++
+
+		provider, err := d.zones.lookup(registered.Domain)
+		if err != nil {
+			result.Drift = append(result.Drift, driftReport{
+				Domain:   registered.Domain,
+				Type:     registered.Type,
+				Expected: registered.Content,
+				Error:    err.Error(),
+			})
+			continue
+		}
+
+		var records []DNSRecord
+		err = withRetry(d.config.Retry, "drift check for "+registered.Domain, func() error {
+			records, err = provider.Records(registered.Domain, registered.Type)
+			return err
+		})
+		if err != nil {
+			fmt.Printf("Drift check failed for %s: %v\n", registered.Domain, err)
+			result.Drift = append(result.Drift, driftReport{
+				Domain:   registered.Domain,
+				Type:     registered.Type,
+				Expected: registered.Content,
+				Error:    err.Error(),
+			})
+			continue
+		}
+
+		if recordsUpToDate(records, registered.Content) {
+			continue
+		}
+
+		report := driftReport{
+			Domain:   registered.Domain,
+			Type:     registered.Type,
+			Expected: registered.Content,
+			Actual:   []string{},
+		}
+		for _, record := range records {
+			report.Actual = append(report.Actual, record.Content)
+		}
+		fmt.Printf("DNS drift detected for %s %s: expected %s, provider has %v\n", report.Domain, report.Type, report.Expected, report.Actual)
+
+		if d.config.DriftPolicy == "repair" && authorized == nil {
+			report.Error = "authorized domains unavailable, not repaired"
+		} else if d.config.DriftPolicy == "repair" {
+			err = withRetry(d.config.Retry, "drift repair for "+registered.Domain, func() error {
+				_, err := provider.SetRecord(registered.Domain, registered.Type, registered.Content, registered.Proxied)
+				return err
+			})
+			if err != nil {
+				fmt.Printf("Error repairing DNS drift for %s: %v\n", registered.Domain, err)
+				report.Error = err.Error()
+			} else {
+				fmt.Printf("Repaired DNS drift: %s -> %s\n", registered.Domain, registered.Content)
+				report.Repaired = true
+			}
+		}
+
+		result.Drift = append(result.Drift, report)
+	}
+
+	d.mu.Lock()
+	d.last = result
+	d.mu.Unlock()
+
+	return result
+}
+
+func (d *driftDetector) lastResult() *driftResult {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.last
+}
+
+func (d *driftDetector) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result := d.check()
+		fmt.Printf("Drift check finished: %d records checked, %d drifted\n", result.Checked, len(result.Drift))
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func newTestServerState(t *testing.T, records ...registeredRecord) *serverState {
+	t.Helper()
+	state, err := loadServerState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatalf("loadServerState: %v", err)
+	}
+	for _, record := range records {
+		if err := state.setRecord(record.Domain, record.Type, record.Content, record.Proxied); err != nil {
+			t.Fatalf("setRecord: %v", err)
+		}
+	}
+	return state
+}
+
+func TestDriftRepair(t *testing.T) {
+	home := newTestClient(t, "home.vozdns.vn")
+	useAuthorizedDomains(t, home)
+	config, zones := newTestDryRunZones(t)
+	config.DriftPolicy = "repair"
+	state := newTestServerState(t,
+		registeredRecord{Domain: "home.vozdns.vn", Type: "A", Content: "1.1.1.1"},
+		registeredRecord{Domain: "home.vozdns.vn", Type: "AAAA", Content: "2606:4700::1111"},
+		registeredRecord{Domain: "revoked.vozdns.vn", Type: "A", Content: "8.8.8.8"},
+	)
+	provider, _ := zones.lookup("home.vozdns.vn")
+	provider.SetRecord("home.vozdns.vn", "A", "9.9.9.9", false)
+	provider.SetRecord("home.vozdns.vn", "AAAA", "2606:4700::1111", false)
+
+	result := newDriftDetector(config, zones, state).check()
+
+	if result.Checked != 2 {
+		t.Errorf("checked %d records, want 2", result.Checked)
+	}
+	if len(result.Drift) != 1 {
+		t.Fatalf("drift = %+v, want only home.vozdns.vn A", result.Drift)
+	}
+	if report := result.Drift[0]; report.Domain != "home.vozdns.vn" || report.Type != "A" || !report.Repaired {
+		t.Errorf("report = %+v, want a repaired home.vozdns.vn A", report)
+	}
+	if records, _ := provider.Records("home.vozdns.vn", "A"); len(records) != 1 || records[0].Content != "1.1.1.1" {
+		t.Errorf("home.vozdns.vn A = %+v, want 1.1.1.1", records)
+	}
+
+	if records, _ := provider.Records("revoked.vozdns.vn", "A"); len(records) != 0 {
+		t.Errorf("revoked domain was recreated: %+v", records)
+	}
+	if state.hasDomain("revoked.vozdns.vn") {
+		t.Error("revoked domain is still in the server state")
+	}
+	if !state.hasDomain("home.vozdns.vn") {
+		t.Error("authorized domain was dropped from the server state")
+	}
+}
+
+func TestDriftRepairWithoutRegistry(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer registry.Close()
+	previous := authorizedDomainsURL
+	authorizedDomainsURL = registry.URL
+	defer func() { authorizedDomainsURL = previous }()
+
+	config, zones := newTestDryRunZones(t)
+	config.DriftPolicy = "repair"
+	state := newTestServerState(t, registeredRecord{Domain: "home.vozdns.vn", Type: "A", Content: "1.1.1.1"})
+
+	result := newDriftDetector(config, zones, state).check()
+
+	if len(result.Drift) != 1 || result.Drift[0].Repaired || result.Drift[0].Error == "" {
+		t.Fatalf("drift = %+v, want one unrepaired report with an error", result.Drift)
+	}
+	provider, _ := zones.lookup("home.vozdns.vn")
+	if records, _ := provider.Records("home.vozdns.vn", "A"); len(records) != 0 {
+		t.Errorf("record was repaired without checking authorization: %+v", records)
+	}
+	if !state.hasDomain("home.vozdns.vn") {
+		t.Error("domain was dropped from the server state")
+	}
+}
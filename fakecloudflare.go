@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fakeCloudflare is an in-memory stand-in for the parts of the Cloudflare v4
+// DNS API the server uses. Point cloudflare_api at it for local development.
+type fakeCloudflare struct {
+	mu      sync.Mutex
+	records map[string][]*fakeCloudflareRecord
+	faults  []*fakeCloudflareFault
+	calls   []string
+	nextID  int
+}
+
+type fakeCloudflareRecord struct {
+	ID      string `json:"id"`
+	ZoneID  string `json:"zone_id"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	Proxied bool   `json:"proxied"`
+	TTL     int    `json:"ttl"`
+}
+
+type fakeCloudflareFault struct {
+	Status     int `json:"status"`
+	RetryAfter int `json:"retry_after"`
+	Remaining  int `json:"remaining"`
+}
+
+func newFakeCloudflare() *fakeCloudflare {
+	return &fakeCloudflare{records: make(map[string][]*fakeCloudflareRecord)}
+}
+
+func (f *fakeCloudflare) injectFault(status, count, retryAfter int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &fakeCloudflareFault{Status: status, RetryAfter: retryAfter, Remaining: count})
+}
+
+func (f *fakeCloudflare) seedRecord(zoneID string, record fakeCloudflareRecord) *fakeCloudflareRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addRecord(zoneID, record)
+}
+
+func (f *fakeCloudflare) addRecord(zoneID string, record fakeCloudflareRecord) *fakeCloudflareRecord {
+	f.nextID++
+	record.ID = fmt.Sprintf("fake%06d", f.nextID)
+	record.ZoneID = zoneID
+	record.Name = strings.ToLower(record.Name)
+	if record.TTL == 0 {
+		record.TTL = 1
+	}
+	f.records[zoneID] = append(f.records[zoneID], &record)
+	return &record
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/client/v4"), "/")
+	if strings.HasPrefix(path, "_fake/") {
+		f.serveControl(w, r, strings.TrimPrefix(path, "_fake/"))
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, r.Method+" "+r.URL.RequestURI())
+
+	if len(f.faults) > 0 {
+		fault := f.faults[0]
+		fault.Remaining--
+		if fault.Remaining <= 0 {
+			f.faults = f.faults[1:]
+		}
+		if fault.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(fault.RetryAfter))
+		}
+		if fault.Status == http.StatusTooManyRequests {
+			writeFakeCloudflareError(w, fault.Status, 971, "Please wait and consider throttling your request speed")
+		} else {
+			writeFakeCloudflareError(w, fault.Status, 10000, http.StatusText(fault.Status))
+		}
+		return
+	}
+
+	bearer := strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+	globalKey := r.Header.Get("X-Auth-Email") != "" && r.Header.Get("X-Auth-Key") != ""
+	if !bearer && !globalKey {
+		writeFakeCloudflareError(w, http.StatusForbidden, 10000, "Authentication error")
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "user/tokens/verify" && r.Method == http.MethodGet:
+		if !bearer {
+			writeFakeCloudflareError(w, http.StatusBadRequest, 1000, "Invalid API Token")
+			return
+		}
+		writeFakeCloudflareResult(w, map[string]string{"id": "fake-token", "status": "active"}, nil)
+		return
+	case path == "user" && r.Method == http.MethodGet:
+		if !globalKey {
+			writeFakeCloudflareError(w, http.StatusBadRequest, 9109, "Unauthorized to access requested resource")
+			return
+		}
+		writeFakeCloudflareResult(w, map[string]string{"id": "fake-user", "email": r.Header.Get("X-Auth-Email")}, nil)
+		return
+	case path == "zones" && r.Method == http.MethodGet:
+		// Zone IDs are the zone names in the fake, so any name can be looked up.
+		name := r.URL.Query().Get("name")
+		zones := []map[string]string{}
+		if name != "" {
+			zones = append(zones, map[string]string{"id": name, "name": name, "status": "active"})
+		}
+		writeFakeCloudflareResult(w, zones, map[string]int{"page": 1, "per_page": 20, "count": len(zones), "total_count": len(zones), "total_pages": 1})
+		return
+	case len(parts) == 2 && parts[0] == "zones" && r.Method == http.MethodGet:
+		writeFakeCloudflareResult(w, map[string]interface{}{
+			"id":          parts[1],
+			"name":        parts[1],
+			"status":      "active",
+			"permissions": []string{"#dns_records:edit", "#dns_records:read", "#zone:read"},
+		}, nil)
+		return
+	}
+
+	if len(parts) < 3 || parts[0] != "zones" || parts[2] != "dns_records" {
+		writeFakeCloudflareError(w, http.StatusNotFound, 7003, "Could not route to "+r.URL.Path)
+		return
+	}
+	zoneID := parts[1]
+
+	switch {
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		f.listRecords(w, r, zoneID)
+	case len(parts) == 3 && r.Method == http.MethodPost:
+		f.createRecord(w, r, zoneID)
+	case len(parts) == 4 && r.Method == http.MethodGet:
+		f.getRecord(w, zoneID, parts[3])
+	case len(parts) == 4 && (r.Method == http.MethodPut || r.Method == http.MethodPatch):
+		f.updateRecord(w, r, zoneID, parts[3])
+	case len(parts) == 4 && r.Method == http.MethodDelete:
+		f.deleteRecord(w, zoneID, parts[3])
+	default:
+		writeFakeCloudflareError(w, http.StatusMethodNotAllowed, 10000, "Method not allowed")
+	}
+}
+
+func (f *fakeCloudflare) listRecords(w http.ResponseWriter, r *http.Request, zoneID string) {
+	query := r.URL.Query()
+
+	var matched []*fakeCloudflareRecord
+	for _, record := range f.records[zoneID] {
+		if name := query.Get("name"); name != "" && record.Name != strings.ToLower(name) {
+			continue
+		}
+		if recordType := query.Get("type"); recordType != "" && record.Type != recordType {
+			continue
+		}
+		if content := query.Get("content"); content != "" && record.Content != content {
+			continue
+		}
+		matched = append(matched, record)
+	}
+
+	page, _ := strconv.Atoi(query.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(query.Get("per_page"))
+	if perPage < 1 {
+		perPage = 100
+	}
+
+	totalPages := (len(matched) + perPage - 1) / perPage
+	result := []*fakeCloudflareRecord{}
+	if start := (page - 1) * perPage; start < len(matched) {
+		end := start + perPage
+		if end > len(matched) {
+			end = len(matched)
+		}
+		result = matched[start:end]
+	}
+
+	writeFakeCloudflareResult(w, result, map[string]int{
+		"page":        page,
+		"per_page":    perPage,
+		"count":       len(result),
+		"total_count": len(matched),
+		"total_pages": totalPages,
+	})
+}
+
+func (f *fakeCloudflare) createRecord(w http.ResponseWriter, r *http.Request, zoneID string) {
+	var record fakeCloudflareRecord
+	if err := json.NewDecoder(r.Body).Decode(&record); err != nil || record.Type == "" || record.Name == "" || record.Content == "" {
+		writeFakeCloudflareError(w, http.StatusBadRequest, 9000, "DNS record is invalid")
+		return
+	}
+
+	for _, existing := range f.records[zoneID] {
+		if existing.Type == record.Type && existing.Name == strings.ToLower(record.Name) && existing.Content == record.Content {
+			writeFakeCloudflareError(w, http.StatusBadRequest, 81058, "An identical record already exists.")
+			return
+		}
+	}
+
+	writeFakeCloudflareResult(w, f.addRecord(zoneID, record), nil)
+}
+
+func (f *fakeCloudflare) findRecord(zoneID, id string) (int, *fakeCloudflareRecord) {
+	for i, record := range f.records[zoneID] {
+		if record.ID == id {
+			return i, record
+		}
+	}
+	return -1, nil
+}
+
+func (f *fakeCloudflare) getRecord(w http.ResponseWriter, zoneID, id string) {
+	_, record := f.findRecord(zoneID, id)
+	if record == nil {
+		writeFakeCloudflareError(w, http.StatusNotFound, 81044, "Record does not exist.")
+		return
+	}
+	writeFakeCloudflareResult(w, record, nil)
+}
+
+func (f *fakeCloudflare) updateRecord(w http.ResponseWriter, r *http.Request, zoneID, id string) {
+	_, record := f.findRecord(zoneID, id)
+	if record == nil {
+		writeFakeCloudflareError(w, http.StatusNotFound, 81044, "Record does not exist.")
+		return
+	}
+
+	var update map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeFakeCloudflareError(w, http.StatusBadRequest, 9000, "DNS record is invalid")
+		return
+	}
+
+	updated := *record
+	for key, value := range update {
+		var err error
+		switch key {
+		case "type":
+			err = json.Unmarshal(value, &updated.Type)
+		case "name":
+			err = json.Unmarshal(value, &updated.Name)
+		case "content":
+			err = json.Unmarshal(value, &updated.Content)
+		case "proxied":
+			err = json.Unmarshal(value, &updated.Proxied)
+		case "ttl":
+			err = json.Unmarshal(value, &updated.TTL)
+		}
+		if err != nil {
+			writeFakeCloudflareError(w, http.StatusBadRequest, 9000, "DNS record is invalid")
+			return
+		}
+	}
+	updated.Name = strings.ToLower(updated.Name)
+
+	*record = updated
+	writeFakeCloudflareResult(w, record, nil)
+}
+
+func (f *fakeCloudflare) deleteRecord(w http.ResponseWriter, zoneID, id string) {
+	i, record := f.findRecord(zoneID, id)
+	if record == nil {
+		writeFakeCloudflareError(w, http.StatusNotFound, 81044, "Record does not exist.")
+		return
+	}
+
+	f.records[zoneID] = append(f.records[zoneID][:i], f.records[zoneID][i+1:]...)
+	writeFakeCloudflareResult(w, map[string]string{"id": id}, nil)
+}
+
+// serveControl handles the /_fake/ endpoints used to inspect the fake and to
+// inject failures: GET state, POST reset, POST faults and POST records.
+func (f *fakeCloudflare) serveControl(w http.ResponseWriter, r *http.Request, action string) {
+	query := r.URL.Query()
+
+	switch {
+	case action == "state" && r.Method == http.MethodGet:
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"records": f.records,
+			"faults":  f.faults,
+			"calls":   f.calls,
+		})
+
+	case action == "reset" && r.Method == http.MethodPost:
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.records = make(map[string][]*fakeCloudflareRecord)
+		f.faults = nil
+		f.calls = nil
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "faults" && r.Method == http.MethodPost:
+		status, err := strconv.Atoi(query.Get("status"))
+		if err != nil || status < 400 {
+			http.Error(w, "status must be an HTTP error code", http.StatusBadRequest)
+			return
+		}
+		count, _ := strconv.Atoi(query.Get("count"))
+		if count < 1 {
+			count = 1
+		}
+		retryAfter, _ := strconv.Atoi(query.Get("retry_after"))
+		f.injectFault(status, count, retryAfter)
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "records" && r.Method == http.MethodPost:
+		var record fakeCloudflareRecord
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil || query.Get("zone") == "" {
+			http.Error(w, "expected ?zone=<id> and a record body", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f.seedRecord(query.Get("zone"), record))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeFakeCloudflareResult(w http.ResponseWriter, result interface{}, resultInfo map[string]int) {
+	response := map[string]interface{}{
+		"success":  true,
+		"errors":   []interface{}{},
+		"messages": []interface{}{},
+		"result":   result,
+	}
+	if resultInfo != nil {
+		response["result_info"] = resultInfo
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeFakeCloudflareError(w http.ResponseWriter, status, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  false,
+		"errors":   []map[string]interface{}{{"code": code, "message": message}},
+		"messages": []interface{}{},
+		"result":   nil,
+	})
+}
+
+func startFakeCloudflare(listen string) {
+	fmt.Printf("Fake Cloudflare API listening on http://%s/client/v4\n", listen)
+	fmt.Printf("Set \"cloudflare_api\" in the server config to this URL to use it.\n")
+
+	err := http.ListenAndServe(listen, newFakeCloudflare())
+	if err != nil {
+		fmt.Printf("Fake Cloudflare API stopped: %v\n", err)
+	}
+}
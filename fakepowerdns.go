@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fakePowerDNS is an in-memory stand-in for the zone endpoints of the
+// PowerDNS Authoritative HTTP API. Any zone can be read, so point
+// powerdns_api at it for local development.
+type fakePowerDNS struct {
+	mu     sync.Mutex
+	zones  map[string]map[string]*fakePowerDNSRRset
+	faults []*fakeCloudflareFault
+	calls  []string
+}
+
+type fakePowerDNSRRset struct {
+	Name       string               `json:"name"`
+	Type       string               `json:"type"`
+	TTL        int                  `json:"ttl"`
+	ChangeType string               `json:"changetype,omitempty"`
+	Records    []fakePowerDNSRecord `json:"records"`
+	Comments   []map[string]string  `json:"comments"`
+}
+
+type fakePowerDNSRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+func newFakePowerDNS() *fakePowerDNS {
+	return &fakePowerDNS{zones: make(map[string]map[string]*fakePowerDNSRRset)}
+}
+
+func (f *fakePowerDNS) injectFault(status, count, retryAfter int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &fakeCloudflareFault{Status: status, RetryAfter: retryAfter, Remaining: count})
+}
+
+func (f *fakePowerDNS) zone(id string) map[string]*fakePowerDNSRRset {
+	id = strings.ToLower(fqdn(id))
+	if f.zones[id] == nil {
+		f.zones[id] = make(map[string]*fakePowerDNSRRset)
+	}
+	return f.zones[id]
+}
+
+func (f *fakePowerDNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	if strings.HasPrefix(path, "_fake/") {
+		f.serveControl(w, r, strings.TrimPrefix(path, "_fake/"))
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, r.Method+" "+r.URL.RequestURI())
+
+	if len(f.faults) > 0 {
+		fault := f.faults[0]
+		fault.Remaining--
+		if fault.Remaining <= 0 {
+			f.faults = f.faults[1:]
+		}
+		if fault.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(fault.RetryAfter))
+		}
+		writeFakePowerDNSError(w, fault.Status, http.StatusText(fault.Status))
+		return
+	}
+
+	if r.Header.Get("X-API-Key") == "" {
+		writeFakePowerDNSError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// api/v1/servers/{server}[/zones/{zone}]
+	parts := strings.Split(path, "/")
+	if len(parts) < 4 || parts[0] != "api" || parts[1] != "v1" || parts[2] != "servers" {
+		writeFakePowerDNSError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	switch {
+	case len(parts) == 4 && r.Method == http.MethodGet:
+		writeFakePowerDNSJSON(w, http.StatusOK, map[string]string{
+			"id":          parts[3],
+			"type":        "Server",
+			"daemon_type": "authoritative",
+			"version":     "fake",
+		})
+	case len(parts) == 6 && parts[4] == "zones" && r.Method == http.MethodGet:
+		zoneID, _ := url.PathUnescape(parts[5])
+		f.getZone(w, zoneID)
+	case len(parts) == 6 && parts[4] == "zones" && r.Method == http.MethodPatch:
+		zoneID, _ := url.PathUnescape(parts[5])
+		f.patchZone(w, r, zoneID)
+	default:
+		writeFakePowerDNSError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (f *fakePowerDNS) getZone(w http.ResponseWriter, zoneID string) {
+	rrsets := []*fakePowerDNSRRset{}
+	for _, rrset := range f.zone(zoneID) {
+		rrsets = append(rrsets, rrset)
+	}
+	sort.Slice(rrsets, func(i, j int) bool {
+		if rrsets[i].Name != rrsets[j].Name {
+			return rrsets[i].Name < rrsets[j].Name
+		}
+		return rrsets[i].Type < rrsets[j].Type
+	})
+
+	writeFakePowerDNSJSON(w, http.StatusOK, map[string]interface{}{
+		"id":     fqdn(zoneID),
+		"name":   fqdn(zoneID),
+		"kind":   "Native",
+		"rrsets": rrsets,
+	})
+}
+
+func (f *fakePowerDNS) patchZone(w http.ResponseWriter, r *http.Request, zoneID string) {
+	var patch struct {
+		RRsets []fakePowerDNSRRset `json:"rrsets"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeFakePowerDNSError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	zone := f.zone(zoneID)
+	origin := strings.ToLower(fqdn(zoneID))
+
+	// Validate everything first, PowerDNS applies a PATCH all or nothing.
+	for _, rrset := range patch.RRsets {
+		name := strings.ToLower(rrset.Name)
+		if !strings.HasSuffix(name, ".") {
+			writeFakePowerDNSError(w, http.StatusUnprocessableEntity, fmt.Sprintf("RRset %s IN %s: Name is not canonical", rrset.Name, rrset.Type))
+			return
+		}
+		if name != origin && !strings.HasSuffix(name, "."+origin) {
+			writeFakePowerDNSError(w, http.StatusUnprocessableEntity, fmt.Sprintf("RRset %s IN %s: Name is out of zone", rrset.Name, rrset.Type))
+			return
+		}
+		if rrset.ChangeType != "REPLACE" && rrset.ChangeType != "DELETE" {
+			writeFakePowerDNSError(w, http.StatusUnprocessableEntity, "Changetype not understood")
+			return
+		}
+		if rrset.ChangeType == "REPLACE" && rrset.TTL <= 0 {
+			writeFakePowerDNSError(w, http.StatusUnprocessableEntity, fmt.Sprintf("RRset %s IN %s: TTL is required", rrset.Name, rrset.Type))
+			return
+		}
+	}
+
+	for _, rrset := range patch.RRsets {
+		rrset.Name = strings.ToLower(rrset.Name)
+		key := rrset.Name + "/" + rrset.Type
+		if rrset.ChangeType == "DELETE" || len(rrset.Records) == 0 {
+			delete(zone, key)
+			continue
+		}
+		rrset.ChangeType = ""
+		if rrset.Comments == nil {
+			rrset.Comments = []map[string]string{}
+		}
+		stored := rrset
+		zone[key] = &stored
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveControl handles the /_fake/ endpoints used to inspect the fake and to
+// inject failures: GET state, POST reset and POST faults.
+func (f *fakePowerDNS) serveControl(w http.ResponseWriter, r *http.Request, action string) {
+	query := r.URL.Query()
+
+	switch {
+	case action == "state" && r.Method == http.MethodGet:
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		writeFakePowerDNSJSON(w, http.StatusOK, map[string]interface{}{
+			"zones":  f.zones,
+			"faults": f.faults,
+			"calls":  f.calls,
+		})
+
+	case action == "reset" && r.Method == http.MethodPost:
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.zones = make(map[string]map[string]*fakePowerDNSRRset)
+		f.faults = nil
+		f.calls = nil
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "faults" && r.Method == http.MethodPost:
+		status, err := strconv.Atoi(query.Get("status"))
+		if err != nil || status < 400 {
+			http.Error(w, "status must be an HTTP error code", http.StatusBadRequest)
+			return
+		}
+		count, _ := strconv.Atoi(query.Get("count"))
+		if count < 1 {
+			count = 1
+		}
+		retryAfter, _ := strconv.Atoi(query.Get("retry_after"))
+		f.injectFault(status, count, retryAfter)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeFakePowerDNSJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeFakePowerDNSError(w http.ResponseWriter, status int, message string) {
+	writeFakePowerDNSJSON(w, status, map[string]string{"error": message})
+}
+
+func startFakePowerDNS(listen string) {
+	fmt.Printf("Fake PowerDNS API listening on http://%s\n", listen)
+	fmt.Printf("Set \"powerdns_api\" in the server config to this URL (any auth_key works).\n")
+
+	err := http.ListenAndServe(listen, newFakePowerDNS())
+	if err != nil {
+		fmt.Printf("Fake PowerDNS API stopped: %v\n", err)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReloadTimeout = 30 * time.Second
+	fileExportHeader     = "Generated by VozDNS, changes will be overwritten"
+)
+
+type FileExportConfig struct {
+	Path          string   `json:"path"`
+	Format        string   `json:"format,omitempty"`
+	TTL           uint32   `json:"ttl,omitempty"`
+	Nameservers   []string `json:"nameservers,omitempty"`
+	Hostmaster    string   `json:"hostmaster,omitempty"`
+	ReloadCommand string   `json:"reload_command,omitempty"`
+	ReloadTimeout Duration `json:"reload_timeout,omitempty"`
+}
+
+// fileProvider writes the zone's records to a BIND zone file or a hosts file
+// for existing tooling to pick up, then runs reload_command. The file is read
+// back at startup, so it is the only state the provider keeps.
+type fileProvider struct {
+	zone   *ZoneConfig
+	config FileExportConfig
+	store  recordStore
+
+	mu     sync.Mutex
+	serial uint32
+}
+
+func newFileProvider(zone *ZoneConfig) (*fileProvider, error) {
+	if zone.File == nil || zone.File.Path == "" {
+		return nil, fmt.Errorf("the file provider needs a \"file\" block with a path")
+	}
+
+	config := *zone.File
+	if config.Format == "" {
+		config.Format = "bind"
+	}
+	if config.TTL == 0 {
+		config.TTL = defaultDNSTTL
+	}
+	if config.ReloadTimeout <= 0 {
+		config.ReloadTimeout = Duration(defaultReloadTimeout)
+	}
+
+	switch config.Format {
+	case "bind":
+		if zone.Name == "" {
+			return nil, fmt.Errorf("BIND zone files need a zone name, configure it in the \"zones\" map")
+		}
+		if config.Hostmaster == "" {
+			config.Hostmaster = "hostmaster." + zone.Name
+		}
+	case "hosts":
+	default:
+		return nil, fmt.Errorf("unknown file format %q, use \"bind\" or \"hosts\"", config.Format)
+	}
+
+	p := &fileProvider{zone: zone, config: config}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *fileProvider) Name() string {
+	return "file"
+}
+
+func (p *fileProvider) Verify() error {
+	if p.config.Format == "bind" && len(p.config.Nameservers) == 0 {
+		return fmt.Errorf("file.nameservers must list at least one name server for BIND zone files")
+	}
+	if args := strings.Fields(p.config.ReloadCommand); len(args) > 0 {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return fmt.Errorf("reload_command: %v", err)
+		}
+	}
+	fmt.Printf("Writing records for zone %s to %s (%s)\n", p.zoneLabel(), p.config.Path, p.config.Format)
+	return nil
+}
+
+func (p *fileProvider) zoneLabel() string {
+	if p.zone.Name != "" {
+		return p.zone.Name
+	}
+	return "(default)"
+}
+
+func (p *fileProvider) Records(name, recordType string) ([]DNSRecord, error) {
+	return p.store.find(normalizeRecordName(name), recordType), nil
+}
+
+func (p *fileProvider) ZoneRecords() ([]DNSRecord, error) {
+	return p.store.snapshot(), nil
+}
+
+func (p *fileProvider) SetRecord(name, recordType, content string, proxied bool) (bool, error) {
+	if err := p.supports(recordType); err != nil {
+		return false, err
+	}
+	if !p.store.set(normalizeRecordName(name), recordType, content, false) {
+		return false, nil
+	}
+	return true, p.write()
+}
+
+func (p *fileProvider) AddRecord(name, recordType, content string) error {
+	if err := p.supports(recordType); err != nil {
+		return err
+	}
+	if !p.store.addUnique(normalizeRecordName(name), recordType, content) {
+		return nil
+	}
+	return p.write()
+}
+
+func (p *fileProvider) DeleteRecords(name, recordType, content string) error {
+	if !p.store.removeMatching(normalizeRecordName(name), recordType, content) {
+		return nil
+	}
+	return p.write()
+}
+
+func (p *fileProvider) supports(recordType string) error {
+	if p.config.Format == "hosts" && recordType != "A" && recordType != "AAAA" {
+		return fmt.Errorf("hosts files can only hold A and AAAA records, not %s", recordType)
+	}
+	return nil
+}
+
+// nextSerial returns a YYYYMMDDnn serial greater than the last one written.
+func (p *fileProvider) nextSerial() uint32 {
+	now := time.Now().UTC()
+	serial := uint32(now.Year()*1000000 + int(now.Month())*10000 + now.Day()*100)
+	if serial <= p.serial {
+		serial = p.serial + 1
+	}
+	return serial
+}
+
+// write renders the records, replaces the file atomically and runs the
+// reload command.
+func (p *fileProvider) write() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var data []byte
+	if p.config.Format == "hosts" {
+		data = p.renderHosts()
+	} else {
+		p.serial = p.nextSerial()
+		data = p.renderBind(p.serial)
+	}
+
+	if err := writeFileAtomic(p.config.Path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", p.config.Path, err)
+	}
+
+	return p.reload()
+}
+
+func (p *fileProvider) renderBind(serial uint32) []byte {
+	var buf bytes.Buffer
+	origin := fqdn(p.zone.Name)
+
+	fmt.Fprintf(&buf, "; %s\n", fileExportHeader)
+	fmt.Fprintf(&buf, "$ORIGIN %s\n$TTL %d\n", origin, p.config.TTL)
+	fmt.Fprintf(&buf, "%s %d IN SOA %s %s %d %d %d %d %d\n", origin, p.config.TTL,
+		fqdn(p.config.Nameservers[0]), fqdn(p.config.Hostmaster), serial,
+		defaultDNSRefresh, defaultDNSRetry, defaultDNSExpire, p.config.TTL)
+	for _, nameserver := range p.config.Nameservers {
+		fmt.Fprintf(&buf, "%s %d IN NS %s\n", origin, p.config.TTL, fqdn(nameserver))
+	}
+
+	for _, record := range p.store.snapshot() {
+		content := record.Content
+		switch record.Type {
+		case "TXT":
+			content = quoteZoneString(content)
+		case "CNAME":
+			content = fqdn(content)
+		}
+		fmt.Fprintf(&buf, "%s %d IN %s %s\n", fqdn(record.Name), p.config.TTL, record.Type, content)
+	}
+
+	return buf.Bytes()
+}
+
+func (p *fileProvider) renderHosts() []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "# %s\n", fileExportHeader)
+	for _, record := range p.store.snapshot() {
+		fmt.Fprintf(&buf, "%s\t%s\n", record.Content, record.Name)
+	}
+
+	return buf.Bytes()
+}
+
+func quoteZoneString(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return `"` + value + `"`
+}
+
+func unquoteZoneString(value string) string {
+	value = strings.TrimSuffix(strings.TrimPrefix(value, `"`), `"`)
+	value = strings.ReplaceAll(value, `\"`, `"`)
+	return strings.ReplaceAll(value, `\\`, `\`)
+}
+
+// load reads back a file this provider wrote earlier. Lines it does not
+// recognise are skipped.
+func (p *fileProvider) load() error {
+	file, err := os.Open(p.config.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", p.config.Path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "$") {
+			continue
+		}
+
+		if p.config.Format == "hosts" {
+			fields := strings.Fields(line)
+			ip := net.ParseIP(fields[0])
+			if ip == nil || len(fields) < 2 {
+				continue
+			}
+			recordType := "AAAA"
+			if ip.To4() != nil {
+				recordType = "A"
+			}
+			for _, name := range fields[1:] {
+				p.store.add(DNSRecord{Type: recordType, Name: normalizeRecordName(name), Content: fields[0]})
+			}
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 5)
+		if len(fields) < 5 || fields[2] != "IN" {
+			continue
+		}
+		switch fields[3] {
+		case "SOA":
+			soa := strings.Fields(fields[4])
+			if len(soa) > 2 {
+				if serial, err := strconv.ParseUint(soa[2], 10, 32); err == nil {
+					p.serial = uint32(serial)
+				}
+			}
+		case "NS":
+		case "TXT":
+			p.store.add(DNSRecord{Type: "TXT", Name: normalizeRecordName(fields[0]), Content: unquoteZoneString(fields[4])})
+		default:
+			p.store.add(DNSRecord{Type: fields[3], Name: normalizeRecordName(fields[0]), Content: normalizeRecordName(fields[4])})
+		}
+	}
+
+	return scanner.Err()
+}
+
+// reload runs reload_command, if set, so the consumer picks up the new file.
+func (p *fileProvider) reload() error {
+	args := strings.Fields(p.config.ReloadCommand)
+	if len(args) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.config.ReloadTimeout))
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("reload command failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
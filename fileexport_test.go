@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestFileProvider(t *testing.T, path, format string) *fileProvider {
+	t.Helper()
+	p, err := newFileProvider(&ZoneConfig{
+		Name: "vozdns.vn",
+		File: &FileExportConfig{Path: path, Format: format, Nameservers: []string{"ns1.vozdns.vn"}},
+	})
+	if err != nil {
+		t.Fatalf("newFileProvider: %v", err)
+	}
+	return p
+}
+
+func storedRecords(p *fileProvider) []DNSRecord {
+	records := p.store.snapshot()
+	for i := range records {
+		records[i].ID = ""
+	}
+	return records
+}
+
+func TestFileProviderRoundTrip(t *testing.T) {
+	tests := []struct {
+		format  string
+		records []DNSRecord
+	}{
+		{
+			format: "bind",
+			records: []DNSRecord{
+				{Type: "A", Name: "home.vozdns.vn", Content: "203.0.113.7"},
+				{Type: "AAAA", Name: "home.vozdns.vn", Content: "2001:db8::7"},
+				{Type: "TXT", Name: "_acme-challenge.home.vozdns.vn", Content: `token with "quotes" and \ backslash`},
+				{Type: "CNAME", Name: "www.vozdns.vn", Content: "home.vozdns.vn"},
+			},
+		},
+		{
+			format: "hosts",
+			records: []DNSRecord{
+				{Type: "A", Name: "home.vozdns.vn", Content: "203.0.113.7"},
+				{Type: "AAAA", Name: "home.vozdns.vn", Content: "2001:db8::7"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "zone")
+			p := newTestFileProvider(t, path, test.format)
+			for _, record := range test.records {
+				if err := p.AddRecord(record.Name, record.Type, record.Content); err != nil {
+					t.Fatalf("AddRecord: %v", err)
+				}
+			}
+
+			loaded := newTestFileProvider(t, path, test.format)
+			if got, want := storedRecords(loaded), storedRecords(p); !reflect.DeepEqual(got, want) {
+				t.Errorf("loaded records = %+v, want %+v", got, want)
+			}
+			if loaded.serial != p.serial {
+				t.Errorf("loaded serial = %d, want %d", loaded.serial, p.serial)
+			}
+		})
+	}
+}
+
+func TestFileProviderRenderBind(t *testing.T) {
+	p := newTestFileProvider(t, filepath.Join(t.TempDir(), "zone"), "bind")
+	p.store.add(DNSRecord{Type: "TXT", Name: "txt.vozdns.vn", Content: `say "hi"`})
+	p.store.add(DNSRecord{Type: "CNAME", Name: "www.vozdns.vn", Content: "home.vozdns.vn"})
+
+	zone := string(p.renderBind(2026101901))
+	for _, line := range []string{
+		"$ORIGIN vozdns.vn.",
+		"vozdns.vn. 60 IN SOA ns1.vozdns.vn. hostmaster.vozdns.vn. 2026101901 3600 600 604800 60",
+		"vozdns.vn. 60 IN NS ns1.vozdns.vn.",
+		`txt.vozdns.vn. 60 IN TXT "say \"hi\""`,
+		"www.vozdns.vn. 60 IN CNAME home.vozdns.vn.",
+	} {
+		if !strings.Contains(zone, line+"\n") {
+			t.Errorf("zone file is missing %q:\n%s", line, zone)
+		}
+	}
+}
+
+func TestFileProviderSerialIncreases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zone")
+	p := newTestFileProvider(t, path, "bind")
+	p.serial = 4000000000
+	if err := p.AddRecord("home.vozdns.vn", "A", "203.0.113.7"); err != nil {
+		t.Fatalf("AddRecord: %v", err)
+	}
+	if p.serial != 4000000001 {
+		t.Errorf("serial = %d, want 4000000001", p.serial)
+	}
+}
+
+func TestFileProviderHostsRejectsTXT(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	p := newTestFileProvider(t, path, "hosts")
+	if err := p.AddRecord("_acme-challenge.vozdns.vn", "TXT", "token"); err == nil {
+		t.Fatal("hosts file accepted a TXT record")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file was written for a rejected record")
+	}
+}
@@ -4,14 +4,17 @@ go 1.23.0
 
 toolchain go1.23.4
 
-require github.com/tidwall/gjson v1.17.1
+require (
+	github.com/hypnguyen1209/ming/v2 v2.0.8
+	github.com/tidwall/gjson v1.17.1
+	github.com/valyala/fasthttp v1.62.0
+	golang.org/x/net v0.40.0
+)
 
 require (
 	github.com/andybalholm/brotli v1.1.1 // indirect
-	github.com/hypnguyen1209/ming/v2 v2.0.8 // indirect
 	github.com/klauspost/compress v1.18.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	github.com/valyala/fasthttp v1.62.0 // indirect
 )
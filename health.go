@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const healthcheckTimeout = 3 * time.Second
+
+// healthServer is the client's optional local HTTP listener. /healthz fails
+// when a domain has not completed a check within its max age, or a failure
+// has gone that long without a successful update. /status shows
+// what the client knows about each domain.
+type healthServer struct {
+	profiles []*ClientConfig
+	state    *clientState
+	maxAge   time.Duration
+	started  time.Time
+}
+
+type domainStatus struct {
+	Domain      string            `json:"domain"`
+	Family      string            `json:"ip_family"`
+	Healthy     bool              `json:"healthy"`
+	IPs         map[string]string `json:"ips"`
+	LastChange  *time.Time        `json:"last_change"`
+	LastCheck   *time.Time        `json:"last_check"`
+	LastSuccess *time.Time        `json:"last_success"`
+	LastFailure *time.Time        `json:"last_failure"`
+	LastError   string            `json:"last_error,omitempty"`
+	NextRun     *time.Time        `json:"next_run"`
+}
+
+func startHealthServer(config *ClientConfig, profiles []*ClientConfig, state *clientState) error {
+	listener, err := net.Listen("tcp", healthListen(config))
+	if err != nil {
+		return err
+	}
+
+	h := &healthServer{
+		profiles: profiles,
+		state:    state,
+		maxAge:   time.Duration(config.HealthMaxAge),
+		started:  time.Now(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.serveHealthz)
+	mux.HandleFunc("/status", h.serveStatus)
+
+	fmt.Printf("Health endpoint listening on http://%s/healthz\n", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			fmt.Printf("Health endpoint stopped: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// domainMaxAge is health_max_age, or three check intervals so one slow or
+// failed cycle does not make the client unhealthy.
+func (h *healthServer) domainMaxAge(config *ClientConfig) time.Duration {
+	if h.maxAge > 0 {
+		return h.maxAge
+	}
+	interval := time.Duration(config.CheckInterval)
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
+	return 3 * (interval + time.Duration(config.Jitter))
+}
+
+func (h *healthServer) statuses() ([]domainStatus, bool) {
+	healthy := true
+	statuses := []domainStatus{}
+	for _, config := range h.profiles {
+		domain := h.state.snapshot(profileStateKey(config))
+
+		// Before the first check, the client gets one max age to start up.
+		maxAge := h.domainMaxAge(config)
+		since := h.started
+		if !domain.LastCheck.IsZero() {
+			since = domain.LastCheck
+		}
+		// A check that only compared the IP with the local state does not
+		// show that the server still accepts updates, so a failure that no
+		// success has followed for max age makes the domain unhealthy too.
+		failing := domain.LastFailure.After(domain.LastSuccess) && time.Since(domain.LastFailure) > maxAge
+		status := domainStatus{
+			Domain:      config.Domain,
+			Family:      profileFamily(config),
+			Healthy:     time.Since(since) <= maxAge && !failing,
+			IPs:         domain.LastIPs,
+			LastChange:  optionalTime(domain.LastChange),
+			LastCheck:   optionalTime(domain.LastCheck),
+			LastSuccess: optionalTime(domain.LastSuccess),
+			LastFailure: optionalTime(domain.LastFailure),
+			LastError:   domain.LastError,
+			NextRun:     optionalTime(domain.NextCheck),
+		}
+		if !status.Healthy {
+			healthy = false
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, healthy
+}
+
+func (h *healthServer) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	statuses, healthy := h.statuses()
+
+	response := map[string]interface{}{"status": "ok"}
+	code := http.StatusOK
+	if !healthy {
+		var stale []string
+		for _, status := range statuses {
+			if !status.Healthy {
+				stale = append(stale, status.Domain)
+			}
+		}
+		response = map[string]interface{}{"status": "unhealthy", "stale": stale}
+		code = http.StatusServiceUnavailable
+	}
+	writeHealthJSON(w, code, response)
+}
+
+func (h *healthServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	statuses, healthy := h.statuses()
+	writeHealthJSON(w, http.StatusOK, map[string]interface{}{
+		"healthy": healthy,
+		"started": h.started.UTC(),
+		"domains": statuses,
+	})
+}
+
+func writeHealthJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// healthListen is health_listen, or $VOZDNS_HEALTH_LISTEN so an image can
+// turn the endpoint on without editing the mounted config.
+func healthListen(config *ClientConfig) string {
+	if config.HealthListen != "" {
+		return config.HealthListen
+	}
+	return os.Getenv("VOZDNS_HEALTH_LISTEN")
+}
+
+// runHealthcheck queries the running client's /healthz, for Docker's
+// HEALTHCHECK. Without a client config (e.g. in server mode) there is
+// nothing to check and it succeeds; a client without a health endpoint
+// fails, since its health cannot be known.
+func runHealthcheck() {
+	config, err := loadClientConfig()
+	if err != nil {
+		fmt.Println("No client config, nothing to check")
+		return
+	}
+
+	listen := healthListen(config)
+	if listen == "" {
+		fmt.Println("Health endpoint not configured, set health_listen or VOZDNS_HEALTH_LISTEN")
+		os.Exit(1)
+	}
+
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		fmt.Printf("Invalid health_listen %q: %v\n", listen, err)
+		os.Exit(1)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+
+	client := &http.Client{Timeout: healthcheckTimeout}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, port) + "/healthz")
+	if err != nil {
+		fmt.Printf("Health check failed: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Println(strings.TrimSpace(string(body)))
+	if resp.StatusCode != http.StatusOK {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthListen(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		env    string
+		want   string
+	}{
+		{name: "unset"},
+		{name: "config", config: "127.0.0.1:9000", want: "127.0.0.1:9000"},
+		{name: "environment", env: "127.0.0.1:8053", want: "127.0.0.1:8053"},
+		{name: "config wins", config: "127.0.0.1:9000", env: "127.0.0.1:8053", want: "127.0.0.1:9000"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("VOZDNS_HEALTH_LISTEN", test.env)
+			if got := healthListen(&ClientConfig{HealthListen: test.config}); got != test.want {
+				t.Errorf("healthListen = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func newTestHealthServer(t *testing.T, update func(domain *domainState)) *httptest.Server {
+	t.Helper()
+	config := &ClientConfig{Domain: "home.vozdns.vn", CheckInterval: Duration(10 * time.Minute)}
+	state := newTestClientState(t)
+	state.mu.Lock()
+	update(state.domain(profileStateKey(config)))
+	state.mu.Unlock()
+
+	h := &healthServer{profiles: []*ClientConfig{config}, state: state, started: time.Now()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.serveHealthz)
+	mux.HandleFunc("/status", h.serveStatus)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func getHealthJSON(t *testing.T, url string, value interface{}) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(value); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	return resp.StatusCode
+}
+
+func TestHealthz(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		update func(domain *domainState)
+		want   int
+	}{
+		{name: "starting", update: func(domain *domainState) {}, want: http.StatusOK},
+		{name: "fresh", update: func(domain *domainState) {
+			domain.LastSuccess = now.Add(-time.Hour)
+			domain.LastCheck = now.Add(-time.Minute)
+		}, want: http.StatusOK},
+		{name: "stale", update: func(domain *domainState) {
+			domain.LastSuccess = now.Add(-time.Hour)
+			domain.LastCheck = now.Add(-time.Hour)
+		}, want: http.StatusServiceUnavailable},
+		{name: "recent failure", update: func(domain *domainState) {
+			domain.LastSuccess = now.Add(-time.Hour)
+			domain.LastFailure = now.Add(-time.Minute)
+			domain.LastCheck = now.Add(-time.Minute)
+		}, want: http.StatusOK},
+		{name: "failing behind unchanged checks", update: func(domain *domainState) {
+			domain.LastSuccess = now.Add(-2 * time.Hour)
+			domain.LastFailure = now.Add(-time.Hour)
+			domain.LastCheck = now.Add(-time.Minute)
+		}, want: http.StatusServiceUnavailable},
+		{name: "failure followed by success", update: func(domain *domainState) {
+			domain.LastFailure = now.Add(-2 * time.Hour)
+			domain.LastSuccess = now.Add(-time.Hour)
+			domain.LastCheck = now.Add(-time.Minute)
+		}, want: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestHealthServer(t, test.update)
+
+			var response struct {
+				Status string   `json:"status"`
+				Stale  []string `json:"stale"`
+			}
+			if code := getHealthJSON(t, server.URL+"/healthz", &response); code != test.want {
+				t.Fatalf("status code = %d, want %d (%+v)", code, test.want, response)
+			}
+			if test.want != http.StatusOK && (response.Status != "unhealthy" || len(response.Stale) != 1 || response.Stale[0] != "home.vozdns.vn") {
+				t.Errorf("response = %+v, want home.vozdns.vn listed", response)
+			}
+		})
+	}
+}
+
+func TestHealthStatus(t *testing.T) {
+	now := time.Now().UTC()
+	server := newTestHealthServer(t, func(domain *domainState) {
+		domain.LastIPs = map[string]string{"ipv4": "1.1.1.1"}
+		domain.LastSuccess = now.Add(-2 * time.Hour)
+		domain.LastFailure = now.Add(-time.Hour)
+		domain.LastError = "Error registering with server: status 500"
+		domain.LastCheck = now
+		domain.NextCheck = now.Add(10 * time.Minute)
+	})
+
+	var response struct {
+		Healthy bool           `json:"healthy"`
+		Domains []domainStatus `json:"domains"`
+	}
+	if code := getHealthJSON(t, server.URL+"/status", &response); code != http.StatusOK {
+		t.Fatalf("status code = %d, want 200 even when unhealthy", code)
+	}
+	if response.Healthy || len(response.Domains) != 1 {
+		t.Fatalf("response = %+v", response)
+	}
+	status := response.Domains[0]
+	if status.Domain != "home.vozdns.vn" || status.Family != "ipv4" || status.Healthy || status.IPs["ipv4"] != "1.1.1.1" {
+		t.Errorf("status = %+v", status)
+	}
+	if status.LastError == "" || status.LastChange != nil || status.NextRun == nil || !status.NextRun.Equal(now.Add(10*time.Minute)) {
+		t.Errorf("status = %+v", status)
+	}
+}
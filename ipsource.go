@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	defaultIPTimeout  = 10 * time.Second
+	maxIPResponseSize = 64 * 1024
+)
+
+// IPSource is one place the client can learn its public IP from: a plain
+// text endpoint ("http"), a JSON endpoint read with a gjson path ("json"),
+// the VozDNS server's /ip endpoint ("server") or a local network interface
+// ("interface").
+type IPSource struct {
+	Type      string   `json:"type"`
+	URL       string   `json:"url,omitempty"`
+	Path      string   `json:"path,omitempty"`
+	Interface string   `json:"interface,omitempty"`
+	Exclude   []string `json:"exclude,omitempty"`
+}
+
+var defaultIPSources = []IPSource{
+	{Type: "http", URL: "https://icanhazip.com"},
+	{Type: "json", URL: "https://api.ipify.org?format=json", Path: "ip"},
+}
+
+func (s IPSource) String() string {
+	switch {
+	case s.URL != "":
+		return s.Type + " " + s.URL
+	case s.Interface != "":
+		return s.Type + " " + s.Interface
+	}
+	return s.Type
+}
+
+// getPublicIP asks the configured sources for the public IP and combines
+// their answers with ip_strategy: "first" (default) takes the first valid
+// answer, "majority" needs more than half of all sources to agree and
+// "two_agree" needs any two.
+func getPublicIP(config *ClientConfig) (string, error) {
+	sources := config.IPSources
+	if len(sources) == 0 {
+		sources = defaultIPSources
+	}
+
+	timeout := time.Duration(config.IPTimeout)
+	if timeout <= 0 {
+		timeout = defaultIPTimeout
+	}
+
+	family := config.IPFamily
+	if family == "" {
+		family = "ipv4"
+	}
+	if family != "ipv4" && family != "ipv6" {
+		return "", fmt.Errorf("unknown ip_family %q (expected ipv4 or ipv6)", family)
+	}
+
+	switch config.IPStrategy {
+	case "", "first":
+		var errs []string
+		for _, source := range sources {
+			ip, err := fetchIP(config, source, timeout, family)
+			if err == nil {
+				return ip, nil
+			}
+			errs = append(errs, fmt.Sprintf("%s: %v", source, err))
+		}
+		return "", fmt.Errorf("no IP source answered: %s", strings.Join(errs, "; "))
+	case "majority":
+		return ipConsensus(config, sources, timeout, family, len(sources)/2+1)
+	case "two_agree":
+		return ipConsensus(config, sources, timeout, family, 2)
+	default:
+		return "", fmt.Errorf("unknown ip_strategy %q (expected first, majority or two_agree)", config.IPStrategy)
+	}
+}
+
+// ipConsensus queries every source at once and returns the address reported
+// by at least needed of them.
+func ipConsensus(config *ClientConfig, sources []IPSource, timeout time.Duration, family string, needed int) (string, error) {
+	ips := make([]string, len(sources))
+	errs := make([]error, len(sources))
+
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func(i int, source IPSource) {
+			defer wg.Done()
+			ips[i], errs[i] = fetchIP(config, source, timeout, family)
+		}(i, source)
+	}
+	wg.Wait()
+
+	votes := make(map[string]int)
+	var answers []string
+	for i, ip := range ips {
+		if errs[i] != nil {
+			fmt.Printf("IP source %s failed: %v\n", sources[i], errs[i])
+			continue
+		}
+		votes[ip]++
+		answers = append(answers, fmt.Sprintf("%s=%s", sources[i], ip))
+		if votes[ip] >= needed {
+			return ip, nil
+		}
+	}
+
+	return "", fmt.Errorf("IP sources did not agree (need %d matching answers): %s", needed, strings.Join(answers, ", "))
+}
+
+func fetchIP(config *ClientConfig, source IPSource, timeout time.Duration, family string) (string, error) {
+	switch source.Type {
+	case "interface":
+		return interfaceIP(source, family)
+	case "http":
+	case "json":
+		if source.Path == "" {
+			return "", fmt.Errorf("json sources need a path")
+		}
+	case "server":
+		path := source.Path
+		if path == "" {
+			path = "ip"
+		}
+		if source.URL != "" {
+			return fetchIPURL(source.URL, path, timeout, family)
+		}
+		var ip string
+		err := withServers(config, func(server ServerEntry) error {
+			var err error
+			ip, err = fetchIPURL(server.URL+"/ip", path, timeout, family)
+			return err
+		})
+		return ip, err
+	default:
+		return "", fmt.Errorf("unknown source type %q", source.Type)
+	}
+	if source.URL == "" {
+		return "", fmt.Errorf("%s sources need a url", source.Type)
+	}
+
+	return fetchIPURL(source.URL, source.Path, timeout, family)
+}
+
+func fetchIPURL(url, path string, timeout time.Duration, family string) (string, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxIPResponseSize))
+	if err != nil {
+		return "", err
+	}
+
+	value := strings.TrimSpace(string(body))
+	if path != "" {
+		result := gjson.GetBytes(body, path)
+		if !result.Exists() {
+			return "", fmt.Errorf("no %q field in response", path)
+		}
+		value = strings.TrimSpace(result.String())
+	}
+
+	return validatePublicIP(value, family)
+}
+
+// validatePublicIP rejects anything that is not a public address of the
+// wanted family, such as an HTML error page or a captive portal's private
+// address.
+func validatePublicIP(value, family string) (string, error) {
+	if len(value) > 64 {
+		value = value[:64] + "..."
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", fmt.Errorf("response is not an IP address: %q", value)
+	}
+	if family == "ipv6" && ip.To4() != nil {
+		return "", fmt.Errorf("%s is not an IPv6 address", ip)
+	}
+	if family != "ipv6" && ip.To4() == nil {
+		return "", fmt.Errorf("%s is not an IPv4 address", ip)
+	}
+	if !isPublicIP(ip) {
+		return "", fmt.Errorf("%s is not a public address", ip)
+	}
+
+	return ip.String(), nil
+}
+
+// specialPurposeNetworks are unicast ranges that are never a host's own
+// public address: carrier-grade NAT, IETF protocol assignments, benchmarking,
+// documentation, NAT64 and reserved blocks.
+var specialPurposeNetworks = mustParseNetworks([]string{
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"240.0.0.0/4",
+	"64:ff9b::/96",
+	"64:ff9b:1::/48",
+	"100::/64",
+	"2001::/23",
+	"2001:db8::/32",
+	"3fff::/20",
+})
+
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !containsIP(specialPurposeNetworks, ip)
+}
+
+// interfaceIP picks a global address of the wanted family from a local
+// interface, or from any interface that is up when none is named. Stable
+// IPv6 addresses are preferred over temporary (privacy) and deprecated ones.
+func interfaceIP(source IPSource, family string) (string, error) {
+	var excluded []*net.IPNet
+	for _, cidr := range source.Exclude {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return "", fmt.Errorf("invalid exclude range %q: %v", cidr, err)
+		}
+		excluded = append(excluded, network)
+	}
+
+	var interfaces []net.Interface
+	if source.Interface != "" {
+		iface, err := net.InterfaceByName(source.Interface)
+		if err != nil {
+			return "", err
+		}
+		interfaces = append(interfaces, *iface)
+	} else {
+		all, err := net.Interfaces()
+		if err != nil {
+			return "", err
+		}
+		for _, iface := range all {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagLoopback == 0 {
+				interfaces = append(interfaces, iface)
+			}
+		}
+	}
+
+	var fallback string
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", iface.Name, err)
+		}
+		flags := ipv6AddressFlags(iface.Name)
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !isPublicIP(ipNet.IP) || (ipNet.IP.To4() != nil) != (family == "ipv4") {
+				continue
+			}
+			if containsIP(excluded, ipNet.IP) {
+				continue
+			}
+
+			ip := ipNet.IP.String()
+			if flags[ip].temporary || flags[ip].deprecated {
+				if fallback == "" {
+					fallback = ip
+				}
+				continue
+			}
+			return ip, nil
+		}
+	}
+
+	if fallback != "" {
+		return fallback, nil
+	}
+	if source.Interface != "" {
+		return "", fmt.Errorf("no global %s address on %s", family, source.Interface)
+	}
+	return "", fmt.Errorf("no global %s address on any interface", family)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseNetworks(entries []string) []*net.IPNet {
+	networks, err := parseNetworks(entries)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+// parseNetworks reads a list of CIDR ranges, where a bare address stands for
+// itself.
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %q: %v", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	ifaFlagTemporary  = 0x01
+	ifaFlagDeprecated = 0x20
+)
+
+type ipv6Flags struct {
+	temporary  bool
+	deprecated bool
+}
+
+// ipv6AddressFlags reads the kernel's flags for the interface's IPv6
+// addresses from /proc/net/if_inet6, which net.Interfaces does not expose.
+func ipv6AddressFlags(ifname string) map[string]ipv6Flags {
+	file, err := os.Open("/proc/net/if_inet6")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	flags := make(map[string]ipv6Flags)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// address ifindex prefixlen scope flags name
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 6 || fields[5] != ifname || len(fields[0]) != 32 {
+			continue
+		}
+
+		var ip net.IP
+		for i := 0; i < 32; i += 2 {
+			b, err := strconv.ParseUint(fields[0][i:i+2], 16, 8)
+			if err != nil {
+				break
+			}
+			ip = append(ip, byte(b))
+		}
+		value, err := strconv.ParseUint(fields[4], 16, 32)
+		if len(ip) != net.IPv6len || err != nil {
+			continue
+		}
+
+		flags[ip.String()] = ipv6Flags{
+			temporary:  value&ifaFlagTemporary != 0,
+			deprecated: value&ifaFlagDeprecated != 0,
+		}
+	}
+
+	return flags
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+type ipv6Flags struct {
+	temporary  bool
+	deprecated bool
+}
+
+// ipv6AddressFlags is only implemented on Linux. Elsewhere every address is
+// treated as stable.
+func ipv6AddressFlags(ifname string) map[string]ipv6Flags {
+	return nil
+}
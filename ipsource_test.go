@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidatePublicIP(t *testing.T) {
+	tests := []struct {
+		value  string
+		family string
+		want   string
+	}{
+		{value: "1.1.1.1", family: "ipv4", want: "1.1.1.1"},
+		{value: "2606:4700::1111", family: "ipv6", want: "2606:4700::1111"},
+		{value: "2606:4700:0::1111", family: "ipv6", want: "2606:4700::1111"},
+		{value: "2001:4860:4860::8888", family: "ipv6", want: "2001:4860:4860::8888"},
+		{value: "1.1.1.1", family: "ipv6"},
+		{value: "2606:4700::1111", family: "ipv4"},
+		{value: "192.168.1.1", family: "ipv4"},
+		{value: "100.64.0.1", family: "ipv4"},
+		{value: "100.127.255.254", family: "ipv4"},
+		{value: "192.0.0.9", family: "ipv4"},
+		{value: "192.0.2.1", family: "ipv4"},
+		{value: "198.18.0.1", family: "ipv4"},
+		{value: "198.51.100.1", family: "ipv4"},
+		{value: "203.0.113.7", family: "ipv4"},
+		{value: "240.0.0.1", family: "ipv4"},
+		{value: "0.1.2.3", family: "ipv4"},
+		{value: "2001:db8::7", family: "ipv6"},
+		{value: "2001::1", family: "ipv6"},
+		{value: "64:ff9b::1.1.1.1", family: "ipv6"},
+		{value: "3fff::1", family: "ipv6"},
+		{value: "10.0.0.1", family: "ipv4"},
+		{value: "127.0.0.1", family: "ipv4"},
+		{value: "169.254.1.1", family: "ipv4"},
+		{value: "fd00::1", family: "ipv6"},
+		{value: "fe80::1", family: "ipv6"},
+		{value: "<html>error</html>", family: "ipv4"},
+		{value: "", family: "ipv4"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value+"/"+test.family, func(t *testing.T) {
+			got, err := validatePublicIP(test.value, test.family)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("accepted %q as %s", test.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validatePublicIP: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidatePublicIPTruncatesGarbage(t *testing.T) {
+	_, err := validatePublicIP(strings.Repeat("x", 1000), "ipv4")
+	if err == nil || len(err.Error()) > 200 {
+		t.Errorf("err = %v, want a short error", err)
+	}
+}
+
+func ipSourceServer(t *testing.T, body string) IPSource {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body == "" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(body + "\n"))
+	}))
+	t.Cleanup(server.Close)
+	return IPSource{Type: "http", URL: server.URL}
+}
+
+func TestIPConsensus(t *testing.T) {
+	tests := []struct {
+		name    string
+		answers []string
+		needed  int
+		want    string
+	}{
+		{name: "two agree", answers: []string{"1.1.1.1", "8.8.8.8", "1.1.1.1"}, needed: 2, want: "1.1.1.1"},
+		{name: "majority", answers: []string{"1.1.1.1", "1.1.1.1", "8.8.8.8"}, needed: 2, want: "1.1.1.1"},
+		{name: "no agreement", answers: []string{"1.1.1.1", "9.9.9.9", "8.8.8.8"}, needed: 2},
+		{name: "failed sources do not vote", answers: []string{"1.1.1.1", "", ""}, needed: 2},
+		{name: "private answers do not vote", answers: []string{"1.1.1.1", "192.168.1.1", "192.168.1.1"}, needed: 2},
+		{name: "CGNAT answers do not vote", answers: []string{"1.1.1.1", "100.64.0.1", "100.64.0.1"}, needed: 2},
+		{name: "failures tolerated", answers: []string{"", "1.1.1.1", "1.1.1.1"}, needed: 2, want: "1.1.1.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sources []IPSource
+			for _, answer := range test.answers {
+				sources = append(sources, ipSourceServer(t, answer))
+			}
+
+			got, err := ipConsensus(&ClientConfig{}, sources, time.Second, "ipv4", test.needed)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("got %s, want no consensus", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ipConsensus: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := parseNetworks([]string{"203.0.113.7", "2001:db8::/64", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("parseNetworks: %v", err)
+	}
+	want := []string{"203.0.113.7/32", "2001:db8::/64", "10.0.0.0/8"}
+	for i, network := range networks {
+		if network.String() != want[i] {
+			t.Errorf("network %d = %s, want %s", i, network, want[i])
+		}
+	}
+
+	if _, err := parseNetworks([]string{"not-an-ip"}); err == nil {
+		t.Error("accepted an invalid entry")
+	}
+}
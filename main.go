@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"time"
 )
 
 type ClientConfig struct {
@@ -10,15 +11,68 @@ type ClientConfig struct {
 	PublicKey  string `json:"publickey"`
 	Domain     string `json:"domain"`
 	ProxySSL   bool   `json:"proxy_ssl"`
+
+	RemoveOnShutdown *bool `json:"remove_on_shutdown,omitempty"`
+
+	IPSources  []IPSource `json:"ip_sources,omitempty"`
+	IPStrategy string     `json:"ip_strategy,omitempty"`
+	IPFamily   string     `json:"ip_family,omitempty"`
+	IPTimeout  Duration   `json:"ip_timeout,omitempty"`
+
+	CheckInterval       Duration `json:"check_interval,omitempty"`
+	Jitter              Duration `json:"jitter,omitempty"`
+	ForceRefresh        Duration `json:"force_refresh,omitempty"`
+	DisableNetworkWatch *bool    `json:"disable_network_watch,omitempty"`
+
+	Servers []string `json:"servers,omitempty"`
+
+	HealthListen string   `json:"health_listen,omitempty"`
+	HealthMaxAge Duration `json:"health_max_age,omitempty"`
+
+	Domains []*ClientConfig `json:"domains,omitempty"`
 }
 
 type ServerConfig struct {
 	PrivateKey string `json:"privatekey"`
 	PublicKey  string `json:"publickey"`
 	Listen     string `json:"listen"`
-	AuthEmail  string `json:"auth_email"`
-	AuthKey    string `json:"auth_key"`
-	ZoneID     string `json:"zone_id"`
+
+	PreviousPrivateKey string `json:"previous_privatekey,omitempty"`
+	ZoneConfig
+
+	Zones map[string]*ZoneConfig `json:"zones,omitempty"`
+	Retry RetryConfig            `json:"retry"`
+
+	StateFile          string   `json:"state_file,omitempty"`
+	AdminToken         string   `json:"admin_token,omitempty"`
+	TrustedProxies     []string `json:"trusted_proxies,omitempty"`
+	DriftCheckInterval Duration `json:"drift_check_interval,omitempty"`
+	DriftPolicy        string   `json:"drift_policy,omitempty"`
+
+	OrphanCheckInterval Duration `json:"orphan_check_interval,omitempty"`
+	OrphanPolicy        string   `json:"orphan_policy,omitempty"`
+	ReconcileIgnore     []string `json:"reconcile_ignore,omitempty"`
+}
+
+type ZoneConfig struct {
+	Name      string `json:"-"`
+	Provider  string `json:"provider,omitempty"`
+	AuthType  string `json:"auth_type,omitempty"`
+	AuthEmail string `json:"auth_email,omitempty"`
+	AuthKey   string `json:"auth_key,omitempty"`
+	ZoneID    string `json:"zone_id,omitempty"`
+
+	CloudflareAPI    string `json:"cloudflare_api,omitempty"`
+	PowerDNSAPI      string `json:"powerdns_api,omitempty"`
+	PowerDNSServerID string `json:"powerdns_server_id,omitempty"`
+	DuplicatePolicy  string `json:"duplicate_policy,omitempty"`
+	DumpFile         string `json:"dump_file,omitempty"`
+
+	DNS  *AuthoritativeConfig `json:"dns,omitempty"`
+	File *FileExportConfig    `json:"file,omitempty"`
+
+	Mirrors      []*ZoneConfig `json:"mirrors,omitempty"`
+	MirrorPolicy string        `json:"mirror_policy,omitempty"`
 }
 
 type VerifyRequest struct {
@@ -32,14 +86,37 @@ type VerifyResponse struct {
 	ProxySSL  bool   `json:"proxy_ssl"`
 	IP        string `json:"ip"`
 	PublicKey string `json:"publickey"`
+
+	// Set after a key rotation: the old key and its signature over
+	// PublicKey, so clients that pinned the old key accept the new one.
+	PreviousPublicKey string `json:"previous_publickey,omitempty"`
+	KeySignature      string `json:"key_signature,omitempty"`
 }
 
 type RegisterRequest struct {
 	EncryptedData string `json:"encrypted_data"`
 }
 
+type SignedRequest struct {
+	Data      string `json:"data"`
+	Signature string `json:"signature"`
+}
+
+type SignedPayload struct {
+	Action    string `json:"action"`
+	Domain    string `json:"domain"`
+	Value     string `json:"value,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
 type ServerInfo struct {
-	Server string `json:"server"`
+	Server  string        `json:"server,omitempty"`
+	Servers []ServerEntry `json:"servers,omitempty"`
+
+	// Signed along with the servers: clients refuse an expired list or one
+	// older than a version they have already seen.
+	Version int64     `json:"version,omitempty"`
+	Expires time.Time `json:"expires"`
 }
 
 type AuthorizedDomain struct {
@@ -52,8 +129,21 @@ func main() {
 		generate       = flag.Bool("generate", false, "Generate client config")
 		generateServer = flag.Bool("generate-server", false, "Generate server config")
 		start          = flag.Bool("start", false, "Start client")
+		unregister     = flag.Bool("unregister", false, "Remove the client's DNS records")
 		server         = flag.Bool("server", false, "Start server")
+		reconcile      = flag.Bool("reconcile", false, "Report orphan DNS records without changing them")
 		domain         = flag.String("domain", "example.vozdns.vn", "Domain for client config")
+		acme           = flag.String("acme", "", "Run as ACME DNS-01 hook (present|cleanup)")
+		fakeCloudflare = flag.String("fake-cloudflare", "", "Run a fake Cloudflare DNS API on the given address")
+		fakePowerDNS   = flag.String("fake-powerdns", "", "Run a fake PowerDNS HTTP API on the given address")
+		acmeWait       = flag.Duration("acme-wait", 0, "Time to wait for DNS propagation after present")
+		signInfo       = flag.String("sign-discovery", "", "Sign a server list and print the server.json to publish")
+		genDiscovery   = flag.Bool("generate-discovery-key", false, "Generate a new discovery signing key")
+		discoveryKey   = flag.String("discovery-key", "discovery.key", "Discovery private key file")
+		trustKey       = flag.Bool("trust-server-key", false, "Trust a changed server key that was refused")
+		once           = flag.Bool("once", false, "Run a single client cycle and exit with a status code")
+		jsonOutput     = flag.Bool("json", false, "Print a JSON summary on stdout (with -once)")
+		healthcheck    = flag.Bool("healthcheck", false, "Query the running client's health endpoint")
 	)
 
 	flag.Parse()
@@ -65,19 +155,63 @@ func main() {
 		generateServerConfig()
 	case *start:
 		startClient()
+	case *healthcheck:
+		runHealthcheck()
+	case *once:
+		runOnce(selectedDomain(*domain), *jsonOutput)
+	case *unregister:
+		unregisterClient(selectedDomain(*domain))
+	case *trustKey:
+		trustServerKey(flag.Arg(0))
 	case *server:
 		startServer()
+	case *reconcile:
+		reconcileReport()
+	case *fakeCloudflare != "":
+		startFakeCloudflare(*fakeCloudflare)
+	case *fakePowerDNS != "":
+		startFakePowerDNS(*fakePowerDNS)
+	case *signInfo != "":
+		signDiscovery(*signInfo, *discoveryKey)
+	case *genDiscovery:
+		generateDiscoveryKey(*discoveryKey)
+	case *acme != "":
+		runACMEHook(*acme, flag.Args(), *acmeWait)
+	case isLegoHook(flag.Args()):
+		runACMEHook(flag.Arg(0), flag.Args()[1:], *acmeWait)
 	default:
 		printUsage()
 	}
 }
 
+// selectedDomain returns -domain if it was set on the command line, and ""
+// (all profiles) otherwise.
+func selectedDomain(domain string) string {
+	selected := ""
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "domain" {
+			selected = domain
+		}
+	})
+	return selected
+}
+
 func printUsage() {
 	fmt.Println("Usage:")
 	fmt.Println("  ./vozdns -generate [-domain <domain>]  # Generate client config")
 	fmt.Println("  ./vozdns -generate-server              # Generate server config")
 	fmt.Println("  ./vozdns -start                        # Start client")
+	fmt.Println("  ./vozdns -once [-json] [-domain <d>]   # Run one update and exit (cron)")
+	fmt.Println("  ./vozdns -healthcheck                  # Check the running client's health")
+	fmt.Println("  ./vozdns -unregister [-domain <d>]     # Remove client DNS records")
+	fmt.Println("  ./vozdns -trust-server-key [<sha256>]  # Accept a changed server key")
 	fmt.Println("  ./vozdns -server                       # Start server")
+	fmt.Println("  ./vozdns -reconcile                    # Report orphan DNS records (dry run)")
+	fmt.Println("  ./vozdns -fake-cloudflare <addr>       # Run fake Cloudflare API (development)")
+	fmt.Println("  ./vozdns -fake-powerdns <addr>         # Run fake PowerDNS API (development)")
+	fmt.Println("  ./vozdns -sign-discovery <file>        # Sign server.json (maintainers)")
+	fmt.Println("  ./vozdns -acme present|cleanup         # ACME DNS-01 hook (certbot)")
+	fmt.Println("  ./vozdns present|cleanup <fqdn> <val>  # ACME DNS-01 hook (lego exec)")
 	fmt.Println("")
 	flag.PrintDefaults()
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// providerStatus is the outcome of one provider's part of a mirrored change,
+// returned to clients in the /register response.
+type providerStatus struct {
+	Provider string `json:"provider"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+
+	err error
+}
+
+// mirrorError is returned when a mirrored change did not satisfy the zone's
+// mirror_policy. Every provider has already been retried, so it is not a
+// providerError and withRetry does not run the whole fan-out again.
+type mirrorError struct {
+	Statuses   []providerStatus
+	Retryable  bool
+	RetryAfter time.Duration
+}
+
+func (e *mirrorError) Error() string {
+	var failed []string
+	for _, status := range e.Statuses {
+		if status.err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", status.Provider, status.err))
+		}
+	}
+	return strings.Join(failed, "; ")
+}
+
+// mirrorProvider publishes every change to the zone's primary provider and
+// to each of its mirrors. Reads come from the primary.
+type mirrorProvider struct {
+	providers []DNSProvider
+	labels    []string
+	policy    string
+	retry     RetryConfig
+}
+
+func newMirrorProvider(zone *ZoneConfig, retry RetryConfig) (*mirrorProvider, error) {
+	p := &mirrorProvider{policy: zone.MirrorPolicy, retry: retry}
+	if p.policy == "" {
+		p.policy = "all"
+	}
+	if p.policy != "all" && p.policy != "primary" && p.policy != "any" {
+		return nil, fmt.Errorf("unknown mirror_policy %q (expected all, primary or any)", p.policy)
+	}
+
+	configs := []*ZoneConfig{zone}
+	for _, mirror := range zone.Mirrors {
+		if mirror == nil {
+			continue
+		}
+		if len(mirror.Mirrors) > 0 {
+			return nil, fmt.Errorf("mirrors cannot have mirrors of their own")
+		}
+		mirrorZone := *mirror
+		mirrorZone.Name = zone.Name
+		configs = append(configs, &mirrorZone)
+	}
+
+	seen := make(map[string]int)
+	for i, config := range configs {
+		provider, err := newProvider(config)
+		if err != nil {
+			if i > 0 {
+				return nil, fmt.Errorf("mirror %d: %v", i, err)
+			}
+			return nil, err
+		}
+
+		label := provider.Name()
+		seen[label]++
+		if seen[label] > 1 {
+			label = fmt.Sprintf("%s#%d", label, seen[label])
+		}
+
+		p.providers = append(p.providers, provider)
+		p.labels = append(p.labels, label)
+	}
+
+	return p, nil
+}
+
+func (p *mirrorProvider) Name() string {
+	return strings.Join(p.labels, "+")
+}
+
+func (p *mirrorProvider) Verify() error {
+	for i, provider := range p.providers {
+		if err := provider.Verify(); err != nil {
+			return fmt.Errorf("%s: %v", p.labels[i], err)
+		}
+	}
+	return nil
+}
+
+func (p *mirrorProvider) Start() error {
+	for i, provider := range p.providers {
+		service, ok := provider.(serviceProvider)
+		if !ok {
+			continue
+		}
+		if err := service.Start(); err != nil {
+			return fmt.Errorf("%s: %v", p.labels[i], err)
+		}
+	}
+	return nil
+}
+
+func (p *mirrorProvider) ZoneName() (string, error) {
+	if namer, ok := p.providers[0].(zoneNamer); ok {
+		return namer.ZoneName()
+	}
+	return "", nil
+}
+
+func (p *mirrorProvider) Records(name, recordType string) ([]DNSRecord, error) {
+	return p.providers[0].Records(name, recordType)
+}
+
+func (p *mirrorProvider) ZoneRecords() ([]DNSRecord, error) {
+	return p.providers[0].ZoneRecords()
+}
+
+func (p *mirrorProvider) SetRecord(name, recordType, content string, proxied bool) (bool, error) {
+	updated, _, err := p.setRecordStatus(name, recordType, content, proxied)
+	return updated, err
+}
+
+// setRecordStatus is SetRecord with the outcome for each provider.
+func (p *mirrorProvider) setRecordStatus(name, recordType, content string, proxied bool) (bool, []providerStatus, error) {
+	return p.fanOut("DNS update for "+name, func(provider DNSProvider) (bool, error) {
+		return provider.SetRecord(name, recordType, content, proxied)
+	})
+}
+
+func (p *mirrorProvider) AddRecord(name, recordType, content string) error {
+	_, _, err := p.fanOut("DNS add for "+name, func(provider DNSProvider) (bool, error) {
+		return true, provider.AddRecord(name, recordType, content)
+	})
+	return err
+}
+
+func (p *mirrorProvider) DeleteRecords(name, recordType, content string) error {
+	_, _, err := p.fanOut("DNS delete for "+name, func(provider DNSProvider) (bool, error) {
+		return true, provider.DeleteRecords(name, recordType, content)
+	})
+	return err
+}
+
+// fanOut runs fn against every provider in parallel, each with its own
+// retries, and applies the mirror policy to the results.
+func (p *mirrorProvider) fanOut(operation string, fn func(DNSProvider) (bool, error)) (bool, []providerStatus, error) {
+	statuses := make([]providerStatus, len(p.providers))
+
+	var wg sync.WaitGroup
+	for i, provider := range p.providers {
+		wg.Add(1)
+		go func(i int, provider DNSProvider) {
+			defer wg.Done()
+
+			var changed bool
+			err := withRetry(p.retry, fmt.Sprintf("%s on %s", operation, p.labels[i]), func() error {
+				var err error
+				changed, err = fn(provider)
+				return err
+			})
+
+			statuses[i] = providerStatus{Provider: p.labels[i], Status: "unchanged", err: err}
+			switch {
+			case err != nil:
+				statuses[i].Status = "failed"
+				statuses[i].Error = err.Error()
+			case changed:
+				statuses[i].Status = "updated"
+			}
+		}(i, provider)
+	}
+	wg.Wait()
+
+	changed := false
+	succeeded := 0
+	for i, status := range statuses {
+		if status.err != nil {
+			fmt.Printf("%s failed on %s: %v\n", operation, p.labels[i], status.err)
+			continue
+		}
+		succeeded++
+		if status.Status == "updated" {
+			changed = true
+		}
+	}
+
+	var ok bool
+	switch p.policy {
+	case "primary":
+		ok = statuses[0].err == nil
+	case "any":
+		ok = succeeded > 0
+	default:
+		ok = succeeded == len(statuses)
+	}
+	if ok {
+		return changed, statuses, nil
+	}
+
+	// The client should retry only if the failures that broke the policy
+	// were transient.
+	failed := statuses
+	if p.policy == "primary" {
+		failed = statuses[:1]
+	}
+	mirrorErr := &mirrorError{Statuses: statuses, Retryable: true}
+	for _, status := range failed {
+		if status.err == nil {
+			continue
+		}
+		retryable, retryAfter := retryableError(status.err)
+		if !retryable {
+			mirrorErr.Retryable = false
+		}
+		if retryAfter > mirrorErr.RetryAfter {
+			mirrorErr.RetryAfter = retryAfter
+		}
+	}
+	return changed, statuses, mirrorErr
+}
+
+// mirrorStatuses returns the per-provider outcome carried by err, if any.
+func mirrorStatuses(err error) []providerStatus {
+	var mirrorErr *mirrorError
+	if errors.As(err, &mirrorErr) {
+		return mirrorErr.Statuses
+	}
+	return nil
+}
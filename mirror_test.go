@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// stubProvider answers every change with a fixed result.
+type stubProvider struct {
+	changed bool
+	err     error
+}
+
+func (p *stubProvider) Name() string {
+	return "stub"
+}
+
+func (p *stubProvider) Verify() error {
+	return nil
+}
+
+func (p *stubProvider) Records(name, recordType string) ([]DNSRecord, error) {
+	return nil, nil
+}
+
+func (p *stubProvider) ZoneRecords() ([]DNSRecord, error) {
+	return nil, nil
+}
+
+func (p *stubProvider) SetRecord(name, recordType, content string, proxied bool) (bool, error) {
+	return p.changed, p.err
+}
+
+func (p *stubProvider) AddRecord(name, recordType, content string) error {
+	return p.err
+}
+
+func (p *stubProvider) DeleteRecords(name, recordType, content string) error {
+	return p.err
+}
+
+func TestMirrorPolicy(t *testing.T) {
+	transient := &providerError{Retryable: true, RetryAfter: 5 * time.Second, Err: errors.New("503")}
+	permanent := &providerError{Status: 403, Err: errors.New("403")}
+
+	tests := []struct {
+		name      string
+		policy    string
+		results   []*stubProvider
+		wantErr   bool
+		retryable bool
+		changed   bool
+		statuses  []string
+	}{
+		{
+			name:     "all succeed",
+			policy:   "all",
+			results:  []*stubProvider{{changed: true}, {}},
+			changed:  true,
+			statuses: []string{"updated", "unchanged"},
+		},
+		{
+			name:      "all with a failed mirror",
+			policy:    "all",
+			results:   []*stubProvider{{changed: true}, {err: transient}},
+			wantErr:   true,
+			retryable: true,
+			changed:   true,
+			statuses:  []string{"updated", "failed"},
+		},
+		{
+			name:     "primary with a failed mirror",
+			policy:   "primary",
+			results:  []*stubProvider{{changed: true}, {err: permanent}},
+			changed:  true,
+			statuses: []string{"updated", "failed"},
+		},
+		{
+			name:     "primary failed",
+			policy:   "primary",
+			results:  []*stubProvider{{err: permanent}, {changed: true}},
+			wantErr:  true,
+			changed:  true,
+			statuses: []string{"failed", "updated"},
+		},
+		{
+			name:     "any with one success",
+			policy:   "any",
+			results:  []*stubProvider{{err: permanent}, {changed: true}},
+			changed:  true,
+			statuses: []string{"failed", "updated"},
+		},
+		{
+			name:     "any with every provider failed",
+			policy:   "any",
+			results:  []*stubProvider{{err: transient}, {err: permanent}},
+			wantErr:  true,
+			statuses: []string{"failed", "failed"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &mirrorProvider{policy: test.policy, retry: RetryConfig{MaxAttempts: 1}}
+			for _, result := range test.results {
+				p.providers = append(p.providers, result)
+				p.labels = append(p.labels, "stub")
+			}
+
+			changed, statuses, err := p.setRecordStatus("home.vozdns.vn", "A", "203.0.113.7", false)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, want error %v", err, test.wantErr)
+			}
+			if changed != test.changed {
+				t.Errorf("changed = %v, want %v", changed, test.changed)
+			}
+			for i, status := range statuses {
+				if status.Status != test.statuses[i] {
+					t.Errorf("provider %d status = %s, want %s", i, status.Status, test.statuses[i])
+				}
+			}
+
+			if err == nil {
+				return
+			}
+			var mirrorErr *mirrorError
+			if !errors.As(err, &mirrorErr) {
+				t.Fatalf("err = %T, want *mirrorError", err)
+			}
+			if mirrorErr.Retryable != test.retryable {
+				t.Errorf("retryable = %v, want %v", mirrorErr.Retryable, test.retryable)
+			}
+			if test.retryable && mirrorErr.RetryAfter != 5*time.Second {
+				t.Errorf("retryAfter = %s, want 5s", mirrorErr.RetryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// rtnetlink multicast groups, from linux/rtnetlink.h.
+const (
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6Ifaddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+// watchNetworkChanges subscribes to the kernel's rtnetlink notifications and
+// sends on the returned channel whenever an address or route is added or
+// removed, e.g. after a PPPoE reconnect. Events are coalesced, so a burst of
+// changes may arrive as one.
+func watchNetworkChanges(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %v", err)
+	}
+
+	groups := uint32(rtmgrpIPv4Ifaddr | rtmgrpIPv6Ifaddr | rtmgrpIPv4Route | rtmgrpIPv6Route)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to subscribe to netlink events: %v", err)
+	}
+
+	// A receive timeout lets the reader notice ctx being cancelled.
+	timeout := syscall.NsecToTimeval(time.Second.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to configure netlink socket: %v", err)
+	}
+
+	events := make(chan struct{}, 1)
+	go func() {
+		defer syscall.Close(fd)
+
+		buf := make([]byte, 64*1024)
+		for ctx.Err() == nil {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			if err == syscall.ENOBUFS {
+				// The kernel dropped events, so something changed.
+				notifyNetworkChange(events)
+				continue
+			}
+			if err != nil {
+				fmt.Printf("Network change watcher stopped: %v\n", err)
+				return
+			}
+
+			messages, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			for _, message := range messages {
+				switch message.Header.Type {
+				case syscall.RTM_NEWADDR, syscall.RTM_DELADDR, syscall.RTM_NEWROUTE, syscall.RTM_DELROUTE:
+					notifyNetworkChange(events)
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
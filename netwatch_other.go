@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// watchNetworkChanges is only implemented on Linux. Elsewhere the client
+// relies on its ticker alone.
+func watchNetworkChanges(ctx context.Context) (<-chan struct{}, error) {
+	return nil, fmt.Errorf("network change notifications are not supported on this platform")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Exit codes of -once, for cron jobs, systemd timers and router scripts.
+// 2 is not used: the flag package exits with it on a usage error.
+var onceExitCodes = map[string]int{
+	cycleUpdated:      0,
+	cycleFailed:       1,
+	cycleUnchanged:    3,
+	cycleIPFailed:     4,
+	cycleUnreachable:  5,
+	cycleUnauthorized: 6,
+	cycleDNSFailed:    7,
+}
+
+// runOnce runs a single cycle for every domain profile, or only for domain
+// when it is not empty, and exits with a code describing the outcome.
+func runOnce(domain string, jsonOutput bool) {
+	os.Exit(runOnceOutput(domain, jsonOutput))
+}
+
+// runOnceOutput returns the exit code of runOnce. With jsonOutput the log
+// goes to stderr and stdout carries a JSON summary.
+func runOnceOutput(domain string, jsonOutput bool) int {
+	stdout := os.Stdout
+	if jsonOutput {
+		os.Stdout = os.Stderr
+	}
+
+	code, results := runOnceCycles(domain)
+	if !jsonOutput {
+		return code
+	}
+
+	os.Stdout = stdout
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"exit_code": code,
+		"results":   results,
+	}, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding summary: %v\n", err)
+		return onceExitCodes[cycleFailed]
+	}
+	fmt.Println(string(data))
+	return code
+}
+
+func runOnceCycles(domain string) (int, []*cycleResult) {
+	profiles, err := loadClientProfiles()
+	if err != nil {
+		fmt.Printf("Error loading config: %v\n", err)
+		return onceExitCodes[cycleFailed], nil
+	}
+
+	state, err := loadClientState()
+	if err != nil {
+		fmt.Printf("Error loading client state: %v\n", err)
+		return onceExitCodes[cycleFailed], nil
+	}
+
+	results := []*cycleResult{}
+	for _, config := range profiles {
+		if domain != "" && normalizeRecordName(config.Domain) != normalizeRecordName(domain) {
+			continue
+		}
+		results = append(results, profileCycle(config, state))
+	}
+	if len(results) == 0 {
+		fmt.Printf("No profile for domain %s\n", domain)
+		return onceExitCodes[cycleFailed], results
+	}
+
+	// The first failure decides the exit code. Otherwise any update gives
+	// 0, and 3 means every domain was already up to date.
+	code := onceExitCodes[cycleUnchanged]
+	for _, result := range results {
+		switch result.Outcome {
+		case cycleUpdated:
+			code = onceExitCodes[cycleUpdated]
+		case cycleUnchanged:
+		default:
+			return onceExitCodes[result.Outcome], results
+		}
+	}
+	return code, results
+}
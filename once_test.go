@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeOnceConfig(t *testing.T, domains ...string) {
+	t.Helper()
+	var extra []map[string]interface{}
+	for _, domain := range domains[1:] {
+		extra = append(extra, map[string]interface{}{"privatekey": "key", "domain": domain})
+	}
+	writeClientConfig(t, map[string]interface{}{"privatekey": "key", "domain": domains[0], "domains": extra})
+	t.Setenv("VOZDNS_STATE_DIR", t.TempDir())
+}
+
+func TestRunOnceExitCodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		outcomes []string
+		want     int
+	}{
+		{name: "updated", outcomes: []string{cycleUpdated}, want: 0},
+		{name: "unchanged", outcomes: []string{cycleUnchanged}, want: 3},
+		{name: "one of two updated", outcomes: []string{cycleUnchanged, cycleUpdated}, want: 0},
+		{name: "ip failed", outcomes: []string{cycleIPFailed}, want: 4},
+		{name: "unreachable", outcomes: []string{cycleUnreachable}, want: 5},
+		{name: "unauthorized", outcomes: []string{cycleUnauthorized}, want: 6},
+		{name: "dns failed", outcomes: []string{cycleDNSFailed}, want: 7},
+		{name: "other failure", outcomes: []string{cycleFailed}, want: 1},
+		{name: "first failure wins", outcomes: []string{cycleUpdated, cycleUnauthorized, cycleIPFailed}, want: 6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var domains []string
+			for i := range test.outcomes {
+				domains = append(domains, fmt.Sprintf("host%d.vozdns.vn", i))
+			}
+			writeOnceConfig(t, domains...)
+			stubProfileCycle(t, func(call int) *cycleResult {
+				return &cycleResult{Domain: domains[call-1], Outcome: test.outcomes[call-1]}
+			})
+
+			code, results := runOnceCycles("")
+			if code != test.want {
+				t.Errorf("exit code = %d, want %d", code, test.want)
+			}
+			if code == 2 {
+				t.Error("exit code 2 is the flag package's usage error")
+			}
+			if len(results) != len(test.outcomes) {
+				t.Errorf("got %d results, want %d", len(results), len(test.outcomes))
+			}
+		})
+	}
+}
+
+func TestRunOnceSelectsDomain(t *testing.T) {
+	writeOnceConfig(t, "home.vozdns.vn", "nas.vozdns.vn")
+	var checked []string
+	previous := profileCycle
+	profileCycle = func(config *ClientConfig, state *clientState) *cycleResult {
+		checked = append(checked, config.Domain)
+		return &cycleResult{Domain: config.Domain, Outcome: cycleUpdated}
+	}
+	t.Cleanup(func() { profileCycle = previous })
+
+	if code, _ := runOnceCycles("NAS.vozdns.vn"); code != 0 || len(checked) != 1 || checked[0] != "nas.vozdns.vn" {
+		t.Errorf("code %d, checked %v, want only nas.vozdns.vn", code, checked)
+	}
+	if code, _ := runOnceCycles("other.vozdns.vn"); code != 1 {
+		t.Errorf("unknown domain: exit code = %d, want 1", code)
+	}
+}
+
+// captureOutput runs fn with stdout and stderr sent to files and returns
+// what was written to each.
+func captureOutput(t *testing.T, fn func()) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer stdout.Close()
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer stderr.Close()
+
+	previousOut, previousErr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = stdout, stderr
+	fn()
+	os.Stdout, os.Stderr = previousOut, previousErr
+
+	out, _ := os.ReadFile(stdout.Name())
+	log, _ := os.ReadFile(stderr.Name())
+	return string(out), string(log)
+}
+
+func TestRunOnceJSONOutput(t *testing.T) {
+	writeOnceConfig(t, "home.vozdns.vn")
+	stubProfileCycle(t, func(int) *cycleResult {
+		fmt.Println("Public IP: 1.1.1.1")
+		return &cycleResult{Domain: "home.vozdns.vn", Outcome: cycleUpdated, IP: "1.1.1.1"}
+	})
+
+	var code int
+	out, log := captureOutput(t, func() { code = runOnceOutput("", true) })
+
+	if code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+	if !strings.Contains(log, "Public IP: 1.1.1.1") {
+		t.Errorf("log did not go to stderr: %q", log)
+	}
+	var summary struct {
+		ExitCode int            `json:"exit_code"`
+		Results  []*cycleResult `json:"results"`
+	}
+	if err := json.Unmarshal([]byte(out), &summary); err != nil {
+		t.Fatalf("stdout is not only the JSON summary: %v\n%s", err, out)
+	}
+	if summary.ExitCode != 0 || len(summary.Results) != 1 || summary.Results[0].IP != "1.1.1.1" {
+		t.Errorf("summary = %+v", summary)
+	}
+}
+
+func TestRunOnceWithoutJSON(t *testing.T) {
+	writeOnceConfig(t, "home.vozdns.vn")
+	stubProfileCycle(t, func(int) *cycleResult {
+		fmt.Println("Public IP: 1.1.1.1")
+		return &cycleResult{Domain: "home.vozdns.vn", Outcome: cycleUnchanged}
+	})
+
+	var code int
+	out, log := captureOutput(t, func() { code = runOnceOutput("", false) })
+
+	if code != 3 {
+		t.Errorf("exit code = %d, want 3", code)
+	}
+	if !strings.Contains(out, "Public IP: 1.1.1.1") || strings.Contains(out, "exit_code") || log != "" {
+		t.Errorf("stdout = %q, stderr = %q, want only the log on stdout", out, log)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type DNSRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	Proxied bool   `json:"proxied,omitempty"`
+}
+
+// DNSProvider is the backend a zone's records are written to. Names are
+// fully qualified without the trailing dot.
+type DNSProvider interface {
+	Name() string
+	// Verify checks the provider is usable before the server starts.
+	Verify() error
+	// Records returns the records with the given name and type.
+	Records(name, recordType string) ([]DNSRecord, error)
+	// ZoneRecords returns every record in the zone.
+	ZoneRecords() ([]DNSRecord, error)
+	// SetRecord makes content the only record with that name and type and
+	// reports whether anything had to change.
+	SetRecord(name, recordType, content string, proxied bool) (bool, error)
+	// AddRecord adds content next to any existing records of that name and type.
+	AddRecord(name, recordType, content string) error
+	// DeleteRecords removes the records of that name and type, or only the
+	// one with the given content when content is not empty.
+	DeleteRecords(name, recordType, content string) error
+}
+
+func newProvider(zone *ZoneConfig) (DNSProvider, error) {
+	switch zone.Provider {
+	case "", "cloudflare":
+		return newCloudflareProvider(zone), nil
+	case "powerdns":
+		return newPowerDNSProvider(zone)
+	case "dryrun":
+		return newDryRunProvider(zone)
+	case "authoritative":
+		return newAuthoritativeProvider(zone)
+	case "file":
+		return newFileProvider(zone)
+	default:
+		return nil, fmt.Errorf("unknown provider %q", zone.Provider)
+	}
+}
+
+// serviceProvider is implemented by providers that run a service of their
+// own, such as the built-in DNS server, started after verification.
+type serviceProvider interface {
+	Start() error
+}
+
+// zoneNamer is implemented by providers that can tell the zone apex when
+// the config does not name the zone.
+type zoneNamer interface {
+	ZoneName() (string, error)
+}
+
+func recordsUpToDate(records []DNSRecord, content string) bool {
+	return len(records) == 1 && records[0].Content == content
+}
+
+// proxiedRecordUpToDate also compares the Cloudflare proxy flag, so a changed
+// proxy_ssl is applied even when the IP is the same.
+func proxiedRecordUpToDate(records []DNSRecord, content string, proxied bool) bool {
+	return recordsUpToDate(records, content) && records[0].Proxied == proxied
+}
+
+// recordStore is an in-memory record set for providers that keep their own
+// state instead of calling an API.
+type recordStore struct {
+	mu      sync.Mutex
+	records []DNSRecord
+	nextID  int
+}
+
+func (s *recordStore) find(name, recordType string) []DNSRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.match(name, recordType)
+}
+
+// match must be called with s.mu held.
+func (s *recordStore) match(name, recordType string) []DNSRecord {
+	var matched []DNSRecord
+	for _, record := range s.records {
+		if record.Name == name && record.Type == recordType {
+			matched = append(matched, record)
+		}
+	}
+	return matched
+}
+
+func (s *recordStore) add(record DNSRecord) DNSRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insert(record)
+}
+
+// insert must be called with s.mu held.
+func (s *recordStore) insert(record DNSRecord) DNSRecord {
+	s.nextID++
+	record.ID = fmt.Sprintf("rec%06d", s.nextID)
+	s.records = append(s.records, record)
+	return record
+}
+
+func (s *recordStore) update(record DNSRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.records {
+		if s.records[i].ID == record.ID {
+			s.records[i] = record
+			return
+		}
+	}
+}
+
+func (s *recordStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drop(id)
+}
+
+// drop must be called with s.mu held.
+func (s *recordStore) drop(id string) {
+	for i := range s.records {
+		if s.records[i].ID == id {
+			s.records = append(s.records[:i], s.records[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *recordStore) snapshot() []DNSRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := append([]DNSRecord(nil), s.records...)
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Name != records[j].Name {
+			return records[i].Name < records[j].Name
+		}
+		return records[i].Type < records[j].Type
+	})
+	return records
+}
+
+func (s *recordStore) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	var records []DNSRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("invalid records file %s: %v", path, err)
+	}
+	for _, record := range records {
+		s.add(record)
+	}
+	return nil
+}
+
+func (s *recordStore) save(path string) error {
+	data, err := json.MarshalIndent(s.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// set makes content the only record with that name and type.
+func (s *recordStore) set(name, recordType, content string, proxied bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existingRecords := s.match(name, recordType)
+	if proxiedRecordUpToDate(existingRecords, content, proxied) {
+		return false
+	}
+
+	for _, record := range existingRecords {
+		s.drop(record.ID)
+	}
+	s.insert(DNSRecord{Type: recordType, Name: name, Content: content, Proxied: proxied})
+	return true
+}
+
+// addUnique adds a record unless an identical one exists.
+func (s *recordStore) addUnique(name, recordType, content string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, record := range s.match(name, recordType) {
+		if record.Content == content {
+			return false
+		}
+	}
+	s.insert(DNSRecord{Type: recordType, Name: name, Content: content})
+	return true
+}
+
+// removeMatching deletes records of that name and type, only those with
+// content when it is not empty.
+func (s *recordStore) removeMatching(name, recordType, content string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := false
+	for _, record := range s.match(name, recordType) {
+		if content != "" && record.Content != content {
+			continue
+		}
+		s.drop(record.ID)
+		removed = true
+	}
+	return removed
+}
+
+// dryRunProvider keeps records in memory and logs the Cloudflare API calls it
+// would have made. It needs no credentials, so it suits tests and staging a
+// server before the real provider is configured.
+type dryRunProvider struct {
+	zone  *ZoneConfig
+	store recordStore
+}
+
+func newDryRunProvider(zone *ZoneConfig) (*dryRunProvider, error) {
+	p := &dryRunProvider{zone: zone}
+
+	if zone.DumpFile != "" {
+		if err := p.store.load(zone.DumpFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func (p *dryRunProvider) Name() string {
+	return "dryrun"
+}
+
+func (p *dryRunProvider) Verify() error {
+	fmt.Printf("Dry-run provider for zone %s: DNS changes are only logged\n", p.zoneLabel())
+	return nil
+}
+
+func (p *dryRunProvider) zoneLabel() string {
+	if p.zone.Name != "" {
+		return p.zone.Name
+	}
+	return "(default)"
+}
+
+func (p *dryRunProvider) logCall(method, path string, payload interface{}) {
+	zoneID := p.zone.ZoneID
+	if zoneID == "" {
+		zoneID = p.zone.Name
+	}
+
+	line := fmt.Sprintf("[dryrun] %s %s/zones/%s%s", method, cloudflareAPIBase(p.zone), zoneID, path)
+	if payload != nil {
+		data, _ := json.Marshal(payload)
+		line += " " + string(data)
+	}
+	fmt.Println(line)
+}
+
+func (p *dryRunProvider) Records(name, recordType string) ([]DNSRecord, error) {
+	p.logCall("GET", fmt.Sprintf("/dns_records?name=%s&type=%s", url.QueryEscape(name), recordType), nil)
+	return p.store.find(name, recordType), nil
+}
+
+func (p *dryRunProvider) ZoneRecords() ([]DNSRecord, error) {
+	p.logCall("GET", "/dns_records", nil)
+	return p.store.snapshot(), nil
+}
+
+func (p *dryRunProvider) SetRecord(name, recordType, content string, proxied bool) (bool, error) {
+	existingRecords, _ := p.Records(name, recordType)
+	if proxiedRecordUpToDate(existingRecords, content, proxied) {
+		return false, nil
+	}
+
+	recordData := map[string]interface{}{
+		"type":    recordType,
+		"name":    name,
+		"content": content,
+		"proxied": proxied,
+	}
+
+	if len(existingRecords) == 0 {
+		p.logCall("POST", "/dns_records", recordData)
+		p.store.add(DNSRecord{Type: recordType, Name: name, Content: content, Proxied: proxied})
+		return true, p.dump()
+	}
+
+	keep := existingRecords[0]
+	p.logCall("PUT", "/dns_records/"+keep.ID, recordData)
+	keep.Content = content
+	keep.Proxied = proxied
+	p.store.update(keep)
+
+	for _, record := range existingRecords[1:] {
+		if p.zone.DuplicatePolicy == "report" {
+			fmt.Printf("Duplicate DNS record for %s: id=%s content=%s (kept id=%s)\n", name, record.ID, record.Content, keep.ID)
+			continue
+		}
+		p.logCall("DELETE", "/dns_records/"+record.ID, nil)
+		p.store.remove(record.ID)
+	}
+
+	return true, p.dump()
+}
+
+func (p *dryRunProvider) AddRecord(name, recordType, content string) error {
+	existingRecords, _ := p.Records(name, recordType)
+	for _, record := range existingRecords {
+		if record.Content == content {
+			return nil
+		}
+	}
+
+	p.logCall("POST", "/dns_records", map[string]interface{}{
+		"type":    recordType,
+		"name":    name,
+		"content": content,
+		"ttl":     60,
+	})
+	p.store.add(DNSRecord{Type: recordType, Name: name, Content: content})
+	return p.dump()
+}
+
+func (p *dryRunProvider) DeleteRecords(name, recordType, content string) error {
+	existingRecords, _ := p.Records(name, recordType)
+	for _, record := range existingRecords {
+		if content != "" && record.Content != content {
+			continue
+		}
+		p.logCall("DELETE", "/dns_records/"+record.ID, nil)
+		p.store.remove(record.ID)
+	}
+	return p.dump()
+}
+
+// dump writes the current records to the zone's dump_file, if one is set.
+func (p *dryRunProvider) dump() error {
+	if p.zone.DumpFile == "" {
+		return nil
+	}
+	return p.store.save(p.zone.DumpFile)
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func normalizeRecordName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRecordStoreConcurrentChanges(t *testing.T) {
+	var store recordStore
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			store.set("home.vozdns.vn", "A", fmt.Sprintf("1.1.1.%d", i), false)
+		}(i)
+		go func() {
+			defer wg.Done()
+			store.addUnique("_acme-challenge.home.vozdns.vn", "TXT", "token")
+		}()
+	}
+	wg.Wait()
+
+	if records := store.find("home.vozdns.vn", "A"); len(records) != 1 {
+		t.Errorf("set left %d A records, want 1", len(records))
+	}
+	if records := store.find("_acme-challenge.home.vozdns.vn", "TXT"); len(records) != 1 {
+		t.Errorf("addUnique left %d TXT records, want 1", len(records))
+	}
+}
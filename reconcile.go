@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type orphanRecord struct {
+	Zone    string `json:"zone"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	Deleted bool   `json:"deleted"`
+	Skipped string `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type reconcileResult struct {
+	CheckedAt time.Time      `json:"checked_at"`
+	Checked   int            `json:"checked"`
+	Orphans   []orphanRecord `json:"orphans"`
+}
+
+// isIgnoredName reports whether name matches reconcile_ignore, which holds
+// exact names and "*.suffix" patterns for records VozDNS does not manage.
+func isIgnoredName(name string, ignore []string) bool {
+	for _, pattern := range ignore {
+		pattern = normalizeRecordName(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(name, "."+suffix) {
+				return true
+			}
+			continue
+		}
+		if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizedNames returns the names in the authorized registry. An empty
+// registry is far more likely a broken fetch than a real state, and acting on
+// it would delete every record, so it is an error.
+func authorizedNames() (map[string]bool, error) {
+	authorizedDomains, err := fetchAuthorizedDomains()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch authorized domains: %v", err)
+	}
+	if len(authorizedDomains) == 0 {
+		return nil, fmt.Errorf("authorized domain list is empty")
+	}
+
+	authorized := make(map[string]bool)
+	for _, authDomain := range authorizedDomains {
+		authorized[normalizeRecordName(authDomain.Domain)] = true
+	}
+	return authorized, nil
+}
+
+// reconcileOrphans finds A and AAAA records for names that are no longer in
+// the authorized registry. Such records keep pointing at someone's old IP and
+// invite subdomain takeover. With apply set, orphans are deleted, but only
+// those this server registered itself: other records in the zone (the apex,
+// www, the update server) were never VozDNS's to remove.
+func reconcileOrphans(config *ServerConfig, zones *zoneRegistry, state *serverState, apply bool) (*reconcileResult, error) {
+	authorized, err := authorizedNames()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &reconcileResult{CheckedAt: time.Now().UTC(), Orphans: []orphanRecord{}}
+
+	for _, zone := range zones.zones {
+		apex := zone.config.Name
+		if namer, ok := zone.provider.(zoneNamer); ok && apex == "" {
+			apex, err = namer.ZoneName()
+			if err != nil {
+				return nil, fmt.Errorf("failed to look up the zone name: %v", err)
+			}
+		}
+
+		var records []DNSRecord
+		err := withRetry(config.Retry, "zone listing for "+zone.config.Name, func() error {
+			records, err = zone.provider.ZoneRecords()
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list records for zone %s: %v", zone.config.Name, err)
+		}
+
+		// Whether a name was registered by this server is decided before any
+		// of its records are deleted, and its state is only cleared once every
+		// record of that name and type is gone.
+		registered := make(map[string]bool)
+		deleted := make(map[string]orphanRecord)
+		failed := make(map[string]bool)
+
+		for _, record := range records {
+			if record.Type != "A" && record.Type != "AAAA" {
+				continue
+			}
+			result.Checked++
+
+			name := normalizeRecordName(record.Name)
+			if authorized[name] || name == apex || isIgnoredName(name, config.ReconcileIgnore) {
+				continue
+			}
+
+			orphan := orphanRecord{
+				Zone:    apex,
+				Name:    name,
+				Type:    record.Type,
+				Content: record.Content,
+			}
+
+			isRegistered, seen := registered[name]
+			if !seen {
+				isRegistered = state != nil && state.hasDomain(name)
+				registered[name] = isRegistered
+			}
+
+			key := stateKey(name, record.Type)
+			if apply && !isRegistered {
+				fmt.Printf("Orphan record: %s %s %s (not registered by this server, not deleting)\n", name, record.Type, record.Content)
+				orphan.Skipped = "not registered by this server"
+			} else if apply {
+				err := withRetry(config.Retry, "orphan delete for "+name, func() error {
+					return zone.provider.DeleteRecords(name, record.Type, record.Content)
+				})
+				if err != nil {
+					fmt.Printf("Error deleting orphan record %s %s: %v\n", name, record.Type, err)
+					orphan.Error = err.Error()
+					failed[key] = true
+				} else {
+					fmt.Printf("Deleted orphan record: %s %s %s\n", name, record.Type, record.Content)
+					orphan.Deleted = true
+					deleted[key] = orphan
+				}
+			} else {
+				fmt.Printf("Orphan record: %s %s %s (not in the authorized registry)\n", name, record.Type, record.Content)
+			}
+
+			result.Orphans = append(result.Orphans, orphan)
+		}
+
+		for key, orphan := range deleted {
+			if failed[key] {
+				continue
+			}
+			if err := state.removeRecord(orphan.Name, orphan.Type); err != nil {
+				fmt.Printf("Error saving server state: %v\n", err)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func runOrphanReconciler(config *ServerConfig, zones *zoneRegistry, state *serverState, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result, err := reconcileOrphans(config, zones, state, config.OrphanPolicy == "delete")
+		if err != nil {
+			fmt.Printf("Orphan reconciliation failed: %v\n", err)
+			continue
+		}
+		fmt.Printf("Orphan reconciliation finished: %d records checked, %d orphans\n", result.Checked, len(result.Orphans))
+	}
+}
+
+// reconcileReport is the -reconcile command: a dry-run listing of orphan
+// records that never changes anything.
+func reconcileReport() {
+	config, err := loadServerConfig()
+	if err != nil {
+		fmt.Printf("Error loading config: %v\n", err)
+		return
+	}
+
+	zones, err := newZoneRegistry(config)
+	if err != nil {
+		fmt.Printf("Error loading zones: %v\n", err)
+		return
+	}
+
+	result, err := reconcileOrphans(config, zones, nil, false)
+	if err != nil {
+		fmt.Printf("Error reconciling: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Checked %d A/AAAA records, found %d orphans.\n", result.Checked, len(result.Orphans))
+	if len(result.Orphans) > 0 {
+		fmt.Println("Set \"orphan_policy\": \"delete\" in the server config to remove them automatically.")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+func TestReconcileOrphans(t *testing.T) {
+	home := newTestClient(t, "home.vozdns.vn")
+	useAuthorizedDomains(t, home)
+	config, zones := newTestDryRunZones(t)
+	config.ReconcileIgnore = []string{"*.static.vozdns.vn"}
+	state := newTestServerState(t,
+		registeredRecord{Domain: "home.vozdns.vn", Type: "A", Content: "1.1.1.1"},
+		registeredRecord{Domain: "revoked.vozdns.vn", Type: "A", Content: "8.8.8.8"},
+		registeredRecord{Domain: "revoked.vozdns.vn", Type: "AAAA", Content: "2001:4860:4860::8888"},
+	)
+
+	provider, _ := zones.lookup("vozdns.vn")
+	for _, record := range []DNSRecord{
+		{Name: "home.vozdns.vn", Type: "A", Content: "1.1.1.1"},
+		{Name: "revoked.vozdns.vn", Type: "A", Content: "8.8.8.8"},
+		{Name: "revoked.vozdns.vn", Type: "A", Content: "8.8.4.4"},
+		{Name: "revoked.vozdns.vn", Type: "AAAA", Content: "2001:4860:4860::8888"},
+		{Name: "revoked.vozdns.vn", Type: "TXT", Content: "not an address"},
+		{Name: "manual.vozdns.vn", Type: "A", Content: "9.9.9.9"},
+		{Name: "cdn.static.vozdns.vn", Type: "A", Content: "9.9.9.9"},
+	} {
+		if err := provider.AddRecord(record.Name, record.Type, record.Content); err != nil {
+			t.Fatalf("AddRecord: %v", err)
+		}
+	}
+
+	result, err := reconcileOrphans(config, zones, state, true)
+	if err != nil {
+		t.Fatalf("reconcileOrphans: %v", err)
+	}
+
+	if result.Checked != 6 {
+		t.Errorf("checked %d records, want 6", result.Checked)
+	}
+	deleted := 0
+	for _, orphan := range result.Orphans {
+		switch orphan.Name {
+		case "revoked.vozdns.vn":
+			if !orphan.Deleted {
+				t.Errorf("orphan %+v was not deleted", orphan)
+			}
+			deleted++
+		case "manual.vozdns.vn":
+			if orphan.Deleted || orphan.Skipped == "" {
+				t.Errorf("record not registered by the server: %+v, want skipped", orphan)
+			}
+		default:
+			t.Errorf("unexpected orphan %+v", orphan)
+		}
+	}
+	if deleted != 3 {
+		t.Errorf("deleted %d revoked records, want all 3", deleted)
+	}
+
+	for _, recordType := range []string{"A", "AAAA"} {
+		if records, _ := provider.Records("revoked.vozdns.vn", recordType); len(records) != 0 {
+			t.Errorf("revoked.vozdns.vn %s left in the zone: %+v", recordType, records)
+		}
+	}
+	if records, _ := provider.Records("manual.vozdns.vn", "A"); len(records) != 1 {
+		t.Errorf("manual.vozdns.vn A = %+v, want it kept", records)
+	}
+	if state.hasDomain("revoked.vozdns.vn") {
+		t.Error("revoked domain is still in the server state")
+	}
+	if !state.hasDomain("home.vozdns.vn") {
+		t.Error("authorized domain was dropped from the server state")
+	}
+}
+
+func TestReconcileOrphansDryRun(t *testing.T) {
+	home := newTestClient(t, "home.vozdns.vn")
+	useAuthorizedDomains(t, home)
+	config, zones := newTestDryRunZones(t)
+	provider, _ := zones.lookup("vozdns.vn")
+	provider.AddRecord("revoked.vozdns.vn", "A", "8.8.8.8")
+
+	result, err := reconcileOrphans(config, zones, nil, false)
+	if err != nil {
+		t.Fatalf("reconcileOrphans: %v", err)
+	}
+	if len(result.Orphans) != 1 || result.Orphans[0].Deleted {
+		t.Errorf("orphans = %+v, want one listed and not deleted", result.Orphans)
+	}
+	if records, _ := provider.Records("revoked.vozdns.vn", "A"); len(records) != 1 {
+		t.Error("dry run deleted the orphan")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetryAttempts       = 4
+	defaultRetryInitialBackoff = time.Second
+	defaultRetryMaxBackoff     = 15 * time.Second
+	defaultRetryDeadline       = 30 * time.Second
+
+	// maxRetryDeadline bounds how long a server handler retries, so clients
+	// waiting on /register (see serverRequestTimeout) are not cut off first.
+	maxRetryDeadline = 45 * time.Second
+)
+
+type RetryConfig struct {
+	MaxAttempts    int      `json:"max_attempts,omitempty"`
+	InitialBackoff Duration `json:"initial_backoff,omitempty"`
+	MaxBackoff     Duration `json:"max_backoff,omitempty"`
+	Deadline       Duration `json:"deadline,omitempty"`
+}
+
+// providerError is returned by DNS provider calls that reached the API (or
+// failed to) so callers can tell a transient failure from a permanent one.
+type providerError struct {
+	Status     int
+	Retryable  bool
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *providerError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *providerError) Unwrap() error {
+	return e.Err
+}
+
+func retryableError(err error) (bool, time.Duration) {
+	var providerErr *providerError
+	if errors.As(err, &providerErr) {
+		return providerErr.Retryable, providerErr.RetryAfter
+	}
+	return false, 0
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// retryAfterFromHeaders reads how long the API asked us to wait, from
+// Retry-After or from the reset field of Cloudflare's rate-limit headers.
+func retryAfterFromHeaders(header http.Header) time.Duration {
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return time.Until(date)
+		}
+	}
+
+	// Ratelimit: "default";r=0;t=30
+	if value := header.Get("Ratelimit"); value != "" {
+		for _, field := range strings.Split(value, ";") {
+			if seconds, ok := strings.CutPrefix(strings.TrimSpace(field), "t="); ok {
+				if n, err := strconv.Atoi(seconds); err == nil {
+					return time.Duration(n) * time.Second
+				}
+			}
+		}
+	}
+
+	if value := header.Get("X-RateLimit-Reset"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	return 0
+}
+
+func (c RetryConfig) withDefaults() RetryConfig {
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = defaultRetryAttempts
+	}
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = Duration(defaultRetryInitialBackoff)
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = Duration(defaultRetryMaxBackoff)
+	}
+	if c.Deadline <= 0 {
+		c.Deadline = Duration(defaultRetryDeadline)
+	}
+	if c.Deadline > Duration(maxRetryDeadline) {
+		c.Deadline = Duration(maxRetryDeadline)
+	}
+	return c
+}
+
+func (c RetryConfig) backoff(attempt int) time.Duration {
+	backoff := time.Duration(c.InitialBackoff) << attempt
+	if backoff <= 0 || backoff > time.Duration(c.MaxBackoff) {
+		backoff = time.Duration(c.MaxBackoff)
+	}
+	// Full jitter spreads out retries from concurrent requests.
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// withRetry runs fn until it succeeds, fails permanently, runs out of
+// attempts or would wait past the policy deadline. The last error is
+// returned unchanged so its retryability reaches the caller.
+func withRetry(policy RetryConfig, operation string, fn func() error) error {
+	policy = policy.withDefaults()
+	deadline := time.Now().Add(time.Duration(policy.Deadline))
+
+	var err error
+	for attempt := 0; attempt < policy.MaxAttempts; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		retryable, retryAfter := retryableError(err)
+		if !retryable || attempt == policy.MaxAttempts-1 {
+			return err
+		}
+
+		wait := policy.backoff(attempt)
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return err
+		}
+
+		fmt.Printf("%s failed (attempt %d/%d), retrying in %s: %v\n", operation, attempt+1, policy.MaxAttempts, wait.Round(time.Millisecond), err)
+		time.Sleep(wait)
+	}
+
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryAfterFromHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{name: "none", header: http.Header{}, want: 0},
+		{name: "seconds", header: http.Header{"Retry-After": {"20"}}, want: 20 * time.Second},
+		{name: "invalid", header: http.Header{"Retry-After": {"soon"}}, want: 0},
+		{name: "ratelimit", header: http.Header{"Ratelimit": {`"default";r=0;t=30`}}, want: 30 * time.Second},
+		{name: "ratelimit without reset", header: http.Header{"Ratelimit": {`"default";r=5`}}, want: 0},
+		{name: "x-ratelimit-reset", header: http.Header{"X-Ratelimit-Reset": {"7"}}, want: 7 * time.Second},
+		{
+			name:   "retry-after wins",
+			header: http.Header{"Retry-After": {"3"}, "Ratelimit": {`"default";r=0;t=30`}},
+			want:   3 * time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := retryAfterFromHeaders(test.header); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRetryAfterFromHeadersDate(t *testing.T) {
+	header := http.Header{"Retry-After": {time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)}}
+	got := retryAfterFromHeaders(header)
+	if got <= 55*time.Second || got > time.Minute {
+		t.Errorf("got %s, want about 1m", got)
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	transient := &providerError{Retryable: true, Err: errors.New("503")}
+	permanent := &providerError{Status: 403, Err: errors.New("403")}
+	policy := RetryConfig{MaxAttempts: 3, InitialBackoff: Duration(time.Millisecond), MaxBackoff: Duration(time.Millisecond)}
+
+	tests := []struct {
+		name     string
+		errs     []error
+		wantErr  error
+		attempts int
+	}{
+		{name: "success", errs: []error{nil}, attempts: 1},
+		{name: "transient then success", errs: []error{transient, transient, nil}, attempts: 3},
+		{name: "permanent", errs: []error{permanent}, wantErr: permanent, attempts: 1},
+		{name: "out of attempts", errs: []error{transient, transient, transient}, wantErr: transient, attempts: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			err := withRetry(policy, "test", func() error {
+				err := test.errs[attempts]
+				attempts++
+				return err
+			})
+			if err != test.wantErr {
+				t.Errorf("err = %v, want %v", err, test.wantErr)
+			}
+			if attempts != test.attempts {
+				t.Errorf("attempts = %d, want %d", attempts, test.attempts)
+			}
+		})
+	}
+}
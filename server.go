@@ -2,36 +2,51 @@ package main
 
 import (
 	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/hypnguyen1209/ming/v2"
 	"github.com/tidwall/gjson"
 	"github.com/valyala/fasthttp"
 )
 
-type CloudflareRecord struct {
-	ID      string `json:"id"`
-	Type    string `json:"type"`
-	Name    string `json:"name"`
-	Content string `json:"content"`
-	Proxied bool   `json:"proxied"`
-}
+// authorizedDomainsURL lists the domains clients may register and the public
+// key each one signs with.
+var authorizedDomainsURL = "https://vozdns.vn/subdomain.json"
 
-func isAuthorizedDomain(domain string) (bool, string, error) {
-	resp, err := http.Get("https://vozdns.vn/subdomain.json")
+func fetchAuthorizedDomains() ([]AuthorizedDomain, error) {
+	resp, err := http.Get(authorizedDomainsURL)
 	if err != nil {
-		return false, "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	var authorizedDomains []AuthorizedDomain
 	err = json.NewDecoder(resp.Body).Decode(&authorizedDomains)
+	if err != nil {
+		return nil, err
+	}
+
+	return authorizedDomains, nil
+}
+
+func isAuthorizedDomain(domain string) (bool, string, error) {
+	authorizedDomains, err := fetchAuthorizedDomains()
 	if err != nil {
 		return false, "", err
 	}
@@ -45,131 +60,763 @@ func isAuthorizedDomain(domain string) (bool, string, error) {
 	return false, "", nil
 }
 
-func getCloudflareRecord(config *ServerConfig, domain string) (*CloudflareRecord, error) {
+const (
+	defaultCloudflareAPI    = "https://api.cloudflare.com/client/v4"
+	cloudflarePageSize      = 100
+	defaultServerRetryAfter = 30 * time.Second
+	providerRequestTimeout  = 10 * time.Second
+	defaultPowerDNSServerID = "localhost"
+	powerDNSTTL             = 60
+)
+
+type cloudflareProvider struct {
+	mu       sync.Mutex
+	zone     *ZoneConfig
+	zoneName string
+}
+
+func newCloudflareProvider(zone *ZoneConfig) *cloudflareProvider {
+	return &cloudflareProvider{zone: zone}
+}
+
+func (p *cloudflareProvider) Name() string {
+	return "cloudflare"
+}
+
+// resolvedZone returns the zone config with its zone ID, looking the ID up
+// by zone name on first use when the config leaves it out.
+func (p *cloudflareProvider) resolvedZone() (*ZoneConfig, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.zone.ZoneID != "" {
+		return p.zone, nil
+	}
+	if p.zone.Name == "" {
+		return nil, fmt.Errorf("zone_id is not configured")
+	}
+
+	zoneID, err := findCloudflareZoneID(p.zone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up zone ID for %s: %v", p.zone.Name, err)
+	}
+
+	fmt.Printf("Discovered zone ID for %s: %s\n", p.zone.Name, zoneID)
+	p.zone.ZoneID = zoneID
+	return p.zone, nil
+}
+
+// ZoneName returns the zone's apex, read from Cloudflare when the config
+// only has a zone_id.
+func (p *cloudflareProvider) ZoneName() (string, error) {
+	if p.zone.Name != "" {
+		return p.zone.Name, nil
+	}
+
+	zone, err := p.resolvedZone()
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.zoneName != "" {
+		return p.zoneName, nil
+	}
+
+	body, err := cloudflareRequest(zone, "GET", fmt.Sprintf("/zones/%s", zone.ZoneID), nil)
+	if err != nil {
+		return "", err
+	}
+	name := normalizeRecordName(gjson.GetBytes(body, "result.name").String())
+	if name == "" {
+		return "", fmt.Errorf("zone %s has no name", zone.ZoneID)
+	}
+	p.zoneName = name
+	return name, nil
+}
+
+func (p *cloudflareProvider) Verify() error {
+	zone, err := p.resolvedZone()
+	if err != nil {
+		return err
+	}
+	return verifyCloudflareCredentials(zone)
+}
+
+func (p *cloudflareProvider) Records(name, recordType string) ([]DNSRecord, error) {
+	zone, err := p.resolvedZone()
+	if err != nil {
+		return nil, err
+	}
+	return getCloudflareRecords(zone, name, recordType)
+}
+
+func (p *cloudflareProvider) ZoneRecords() ([]DNSRecord, error) {
+	zone, err := p.resolvedZone()
+	if err != nil {
+		return nil, err
+	}
+	return getCloudflareRecords(zone, "", "")
+}
+
+func (p *cloudflareProvider) SetRecord(name, recordType, content string, proxied bool) (bool, error) {
+	zone, err := p.resolvedZone()
+	if err != nil {
+		return false, err
+	}
+
+	existingRecords, err := getCloudflareRecords(zone, name, recordType)
+	if err != nil {
+		return false, err
+	}
+	if proxiedRecordUpToDate(existingRecords, content, proxied) {
+		return false, nil
+	}
+
+	return true, updateCloudflareRecord(zone, name, recordType, content, proxied, existingRecords)
+}
+
+func (p *cloudflareProvider) AddRecord(name, recordType, content string) error {
+	zone, err := p.resolvedZone()
+	if err != nil {
+		return err
+	}
+	return createCloudflareRecord(zone, name, recordType, content)
+}
+
+func (p *cloudflareProvider) DeleteRecords(name, recordType, content string) error {
+	zone, err := p.resolvedZone()
+	if err != nil {
+		return err
+	}
+	return deleteCloudflareRecords(zone, name, recordType, content)
+}
+
+func cloudflareAPIBase(zone *ZoneConfig) string {
+	if zone.CloudflareAPI != "" {
+		return strings.TrimSuffix(zone.CloudflareAPI, "/")
+	}
+	return defaultCloudflareAPI
+}
+
+func setCloudflareAuth(req *http.Request, zone *ZoneConfig) {
+	if zone.AuthType == "global_key" {
+		req.Header.Set("X-Auth-Email", zone.AuthEmail)
+		req.Header.Set("X-Auth-Key", zone.AuthKey)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+zone.AuthKey)
+}
+
+func verifyCloudflareCredentials(zone *ZoneConfig) error {
+	switch zone.AuthType {
+	case "", "token":
+		body, err := cloudflareRequest(zone, "GET", "/user/tokens/verify", nil)
+		if err != nil {
+			return fmt.Errorf("API token rejected by Cloudflare: %v", err)
+		}
+		if status := gjson.GetBytes(body, "result.status").String(); status != "active" {
+			return fmt.Errorf("API token is not active (status: %s)", status)
+		}
+	case "global_key":
+		if zone.AuthEmail == "" {
+			return fmt.Errorf("auth_email is required when auth_type is global_key")
+		}
+		if _, err := cloudflareRequest(zone, "GET", "/user", nil); err != nil {
+			return fmt.Errorf("global API key rejected by Cloudflare: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown auth_type %q (expected token or global_key)", zone.AuthType)
+	}
+
+	body, err := cloudflareRequest(zone, "GET", fmt.Sprintf("/zones/%s", zone.ZoneID), nil)
+	if err != nil {
+		return fmt.Errorf("credentials cannot access zone %s: %v", zone.ZoneID, err)
+	}
+
+	permissions := gjson.GetBytes(body, "result.permissions").Array()
+	if len(permissions) > 0 {
+		canEdit := false
+		for _, permission := range permissions {
+			if permission.String() == "#dns_records:edit" {
+				canEdit = true
+				break
+			}
+		}
+		if !canEdit {
+			return fmt.Errorf("credentials cannot edit DNS records in zone %s", gjson.GetBytes(body, "result.name").String())
+		}
+	}
+
+	fmt.Printf("Cloudflare credentials verified for zone %s\n", gjson.GetBytes(body, "result.name").String())
+	return nil
+}
 
-	if config.AuthKey == "(Your API Token)" || config.ZoneID == "(Can be found in the \"Overview\" tab of your domain)" {
-		fmt.Printf("Using test credentials - simulating DNS record check for %s\n", domain)
+func findCloudflareZoneID(zone *ZoneConfig) (string, error) {
+	path := fmt.Sprintf("/zones?name=%s", url.QueryEscape(zone.Name))
+	body, err := cloudflareRequest(zone, "GET", path, nil)
+	if err != nil {
+		return "", err
+	}
 
-		return &CloudflareRecord{
-			ID:      "test-record-id",
-			Type:    "A",
-			Name:    domain,
-			Content: "0.0.0.0",
-			Proxied: false,
-		}, nil
+	zones := gjson.GetBytes(body, "result").Array()
+	if len(zones) == 0 {
+		return "", fmt.Errorf("zone %s not found in this Cloudflare account", zone.Name)
 	}
 
-	url := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records?name=%s&type=A", config.ZoneID, domain)
+	return zones[0].Get("id").String(), nil
+}
+
+func cloudflareRequest(zone *ZoneConfig, method, path string, payload interface{}) ([]byte, error) {
+	var body io.Reader
+	if payload != nil {
+		jsonData, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewBuffer(jsonData)
+	}
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequest(method, cloudflareAPIBase(zone)+path, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+config.AuthKey)
+	setCloudflareAuth(req, zone)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
+	client := &http.Client{Timeout: providerRequestTimeout}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make request: %v", err)
+		return nil, &providerError{Retryable: true, Err: fmt.Errorf("failed to make request: %v", err)}
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("cloudflare API returned status %d", resp.StatusCode)
-	}
-
-	body, err := io.ReadAll(resp.Body)
+	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %v", err)
+		return nil, &providerError{Retryable: true, Err: fmt.Errorf("failed to read response: %v", err)}
 	}
 
-	if !gjson.GetBytes(body, "success").Bool() {
-		errors := gjson.GetBytes(body, "errors").Array()
-		return nil, fmt.Errorf("cloudflare API error: %v", errors)
+	if !gjson.GetBytes(respBody, "success").Bool() {
+		errors := gjson.GetBytes(respBody, "errors").Array()
+		return nil, &providerError{
+			Status:     resp.StatusCode,
+			Retryable:  isRetryableStatus(resp.StatusCode),
+			RetryAfter: retryAfterFromHeaders(resp.Header),
+			Err:        fmt.Errorf("cloudflare API error (status %d): %v", resp.StatusCode, errors),
+		}
 	}
 
-	records := gjson.GetBytes(body, "result").Array()
-	if len(records) == 0 {
-		return nil, nil
+	return respBody, nil
+}
+
+// getCloudflareRecords lists the zone's records with the given name and type,
+// following pagination. Empty filters match every record.
+func getCloudflareRecords(zone *ZoneConfig, name, recordType string) ([]DNSRecord, error) {
+	query := url.Values{}
+	if name != "" {
+		query.Set("name", name)
+	}
+	if recordType != "" {
+		query.Set("type", recordType)
 	}
+	query.Set("per_page", strconv.Itoa(cloudflarePageSize))
+
+	var records []DNSRecord
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		path := fmt.Sprintf("/zones/%s/dns_records?%s", zone.ZoneID, query.Encode())
+		body, err := cloudflareRequest(zone, "GET", path, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, result := range gjson.GetBytes(body, "result").Array() {
+			records = append(records, DNSRecord{
+				ID:      result.Get("id").String(),
+				Type:    result.Get("type").String(),
+				Name:    result.Get("name").String(),
+				Content: strings.Trim(result.Get("content").String(), "\""),
+				Proxied: result.Get("proxied").Bool(),
+			})
+		}
 
-	firstRecord := records[0]
-	record := &CloudflareRecord{
-		ID:      firstRecord.Get("id").String(),
-		Type:    firstRecord.Get("type").String(),
-		Name:    firstRecord.Get("name").String(),
-		Content: firstRecord.Get("content").String(),
-		Proxied: firstRecord.Get("proxied").Bool(),
+		totalPages := gjson.GetBytes(body, "result_info.total_pages").Int()
+		if int64(page) >= totalPages {
+			break
+		}
 	}
 
-	return record, nil
+	return records, nil
 }
 
-func updateCloudflareRecord(config *ServerConfig, domain, ip string, proxied bool) error {
+func updateCloudflareRecord(zone *ZoneConfig, domain, recordType, content string, proxied bool, existingRecords []DNSRecord) error {
+	recordData := map[string]interface{}{
+		"type":    recordType,
+		"name":    domain,
+		"content": content,
+		"proxied": proxied,
+	}
 
-	if config.AuthKey == "(Your API Token)" || config.ZoneID == "(Can be found in the \"Overview\" tab of your domain)" {
-		fmt.Printf("Using test credentials - simulating DNS update for %s -> %s (proxied: %v)\n", domain, ip, proxied)
-		return nil
+	if len(existingRecords) == 0 {
+		_, err := cloudflareRequest(zone, "POST", fmt.Sprintf("/zones/%s/dns_records", zone.ZoneID), recordData)
+		return err
+	}
+
+	// Keep the record that already has the right content if there is one, so
+	// cleaning up duplicates never removes the only correct answer.
+	keep := 0
+	for i, record := range existingRecords {
+		if record.Content == content {
+			keep = i
+			break
+		}
+	}
+
+	keepRecord := existingRecords[keep]
+	if keepRecord.Content != content || keepRecord.Proxied != proxied {
+		_, err := cloudflareRequest(zone, "PUT", fmt.Sprintf("/zones/%s/dns_records/%s", zone.ZoneID, keepRecord.ID), recordData)
+		if err != nil {
+			return err
+		}
 	}
 
-	existingRecord, err := getCloudflareRecord(config, domain)
+	for i, record := range existingRecords {
+		if i == keep {
+			continue
+		}
+
+		if zone.DuplicatePolicy == "report" {
+			fmt.Printf("Duplicate DNS record for %s: id=%s content=%s (kept id=%s)\n", domain, record.ID, record.Content, keepRecord.ID)
+			continue
+		}
+
+		_, err := cloudflareRequest(zone, "DELETE", fmt.Sprintf("/zones/%s/dns_records/%s", zone.ZoneID, record.ID), nil)
+		if err != nil {
+			return fmt.Errorf("failed to delete duplicate record %s: %v", record.ID, err)
+		}
+		fmt.Printf("Deleted duplicate DNS record for %s: id=%s content=%s\n", domain, record.ID, record.Content)
+	}
+
+	return nil
+}
+
+func createCloudflareRecord(zone *ZoneConfig, name, recordType, content string) error {
+	records, err := getCloudflareRecords(zone, name, recordType)
 	if err != nil {
 		return err
 	}
 
-	var url string
-	var method string
+	for _, record := range records {
+		if record.Content == content {
+			return nil
+		}
+	}
 
 	recordData := map[string]interface{}{
-		"type":    "A",
-		"name":    domain,
-		"content": ip,
-		"proxied": proxied,
+		"type":    recordType,
+		"name":    name,
+		"content": content,
+		"ttl":     60,
+	}
+
+	_, err = cloudflareRequest(zone, "POST", fmt.Sprintf("/zones/%s/dns_records", zone.ZoneID), recordData)
+	return err
+}
+
+func deleteCloudflareRecords(zone *ZoneConfig, name, recordType, content string) error {
+	records, err := getCloudflareRecords(zone, name, recordType)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if content != "" && record.Content != content {
+			continue
+		}
+		_, err = cloudflareRequest(zone, "DELETE", fmt.Sprintf("/zones/%s/dns_records/%s", zone.ZoneID, record.ID), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// powerDNSProvider writes records through the PowerDNS Authoritative HTTP
+// API. auth_key is the X-API-Key and zone_id the PowerDNS zone, which
+// defaults to the zone name.
+type powerDNSProvider struct {
+	zone *ZoneConfig
+}
+
+func newPowerDNSProvider(zone *ZoneConfig) (*powerDNSProvider, error) {
+	if zone.PowerDNSAPI == "" {
+		return nil, fmt.Errorf("powerdns_api is not configured")
+	}
+	if zone.ZoneID == "" && zone.Name == "" {
+		return nil, fmt.Errorf("zone_id is not configured")
+	}
+	return &powerDNSProvider{zone: zone}, nil
+}
+
+func (p *powerDNSProvider) Name() string {
+	return "powerdns"
+}
+
+func (p *powerDNSProvider) Verify() error {
+	if _, err := powerDNSRequest(p.zone, "GET", "", nil); err != nil {
+		return fmt.Errorf("PowerDNS API key rejected: %v", err)
+	}
+
+	body, err := powerDNSRequest(p.zone, "GET", powerDNSZonePath(p.zone), nil)
+	if err != nil {
+		return fmt.Errorf("cannot access zone %s: %v", powerDNSZoneID(p.zone), err)
 	}
 
-	if existingRecord != nil {
+	fmt.Printf("PowerDNS credentials verified for zone %s\n", gjson.GetBytes(body, "name").String())
+	return nil
+}
+
+func (p *powerDNSProvider) Records(name, recordType string) ([]DNSRecord, error) {
+	return getPowerDNSRecords(p.zone, name, recordType)
+}
 
-		url = fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records/%s", config.ZoneID, existingRecord.ID)
-		method = "PUT"
-	} else {
+func (p *powerDNSProvider) ZoneRecords() ([]DNSRecord, error) {
+	return getPowerDNSRecords(p.zone, "", "")
+}
 
-		url = fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records", config.ZoneID)
-		method = "POST"
+func (p *powerDNSProvider) SetRecord(name, recordType, content string, proxied bool) (bool, error) {
+	existingRecords, err := getPowerDNSRecords(p.zone, name, recordType)
+	if err != nil {
+		return false, err
+	}
+	if recordsUpToDate(existingRecords, content) {
+		return false, nil
 	}
 
-	jsonData, err := json.Marshal(recordData)
+	return true, patchPowerDNSRRset(p.zone, name, recordType, []string{content})
+}
+
+func (p *powerDNSProvider) AddRecord(name, recordType, content string) error {
+	existingRecords, err := getPowerDNSRecords(p.zone, name, recordType)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(jsonData))
+	contents := []string{content}
+	for _, record := range existingRecords {
+		if record.Content == content {
+			return nil
+		}
+		contents = append(contents, record.Content)
+	}
+
+	return patchPowerDNSRRset(p.zone, name, recordType, contents)
+}
+
+func (p *powerDNSProvider) DeleteRecords(name, recordType, content string) error {
+	existingRecords, err := getPowerDNSRecords(p.zone, name, recordType)
 	if err != nil {
 		return err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+config.AuthKey)
+	var remaining []string
+	for _, record := range existingRecords {
+		if content != "" && record.Content != content {
+			remaining = append(remaining, record.Content)
+		}
+	}
+	if len(remaining) == len(existingRecords) {
+		return nil
+	}
+
+	return patchPowerDNSRRset(p.zone, name, recordType, remaining)
+}
+
+func powerDNSZoneID(zone *ZoneConfig) string {
+	if zone.ZoneID != "" {
+		return zone.ZoneID
+	}
+	return zone.Name + "."
+}
+
+func powerDNSZonePath(zone *ZoneConfig) string {
+	return "/zones/" + url.PathEscape(powerDNSZoneID(zone))
+}
+
+func powerDNSRequest(zone *ZoneConfig, method, path string, payload interface{}) ([]byte, error) {
+	var body io.Reader
+	if payload != nil {
+		jsonData, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewBuffer(jsonData)
+	}
+
+	serverID := zone.PowerDNSServerID
+	if serverID == "" {
+		serverID = defaultPowerDNSServerID
+	}
+	endpoint := fmt.Sprintf("%s/api/v1/servers/%s%s", strings.TrimSuffix(zone.PowerDNSAPI, "/"), url.PathEscape(serverID), path)
+
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("X-API-Key", zone.AuthKey)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
+	client := &http.Client{Timeout: providerRequestTimeout}
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, &providerError{Retryable: true, Err: fmt.Errorf("failed to make request: %v", err)}
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to read response: %v", err)
+		return nil, &providerError{Retryable: true, Err: fmt.Errorf("failed to read response: %v", err)}
 	}
 
-	if !gjson.GetBytes(body, "success").Bool() {
-		errors := gjson.GetBytes(body, "errors").Array()
-		return fmt.Errorf("cloudflare API error: %v", errors)
+	if resp.StatusCode >= 300 {
+		message := gjson.GetBytes(respBody, "error").String()
+		if message == "" {
+			message = strings.TrimSpace(string(respBody))
+		}
+		return nil, &providerError{
+			Status:     resp.StatusCode,
+			Retryable:  isRetryableStatus(resp.StatusCode),
+			RetryAfter: retryAfterFromHeaders(resp.Header),
+			Err:        fmt.Errorf("powerdns API error (status %d): %s", resp.StatusCode, message),
+		}
 	}
 
-	return nil
+	return respBody, nil
+}
+
+// getPowerDNSRecords reads the zone's RRsets and returns the enabled records
+// with the given name and type. Empty filters match every record.
+func getPowerDNSRecords(zone *ZoneConfig, name, recordType string) ([]DNSRecord, error) {
+	body, err := powerDNSRequest(zone, "GET", powerDNSZonePath(zone), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	name = normalizeRecordName(name)
+
+	var records []DNSRecord
+	for _, rrset := range gjson.GetBytes(body, "rrsets").Array() {
+		rrsetName := normalizeRecordName(rrset.Get("name").String())
+		rrsetType := rrset.Get("type").String()
+		if (name != "" && rrsetName != name) || (recordType != "" && rrsetType != recordType) {
+			continue
+		}
+
+		for _, record := range rrset.Get("records").Array() {
+			if record.Get("disabled").Bool() {
+				continue
+			}
+			content := record.Get("content").String()
+			if rrsetType == "TXT" {
+				content = unquoteZoneString(content)
+			}
+			records = append(records, DNSRecord{Type: rrsetType, Name: rrsetName, Content: content})
+		}
+	}
+
+	return records, nil
+}
+
+// patchPowerDNSRRset replaces the RRset with the given contents, or deletes
+// it when there are none.
+func patchPowerDNSRRset(zone *ZoneConfig, name, recordType string, contents []string) error {
+	rrset := map[string]interface{}{
+		"name":       fqdn(normalizeRecordName(name)),
+		"type":       recordType,
+		"changetype": "DELETE",
+	}
+
+	if len(contents) > 0 {
+		var records []map[string]interface{}
+		for _, content := range contents {
+			if recordType == "TXT" {
+				content = quoteZoneString(content)
+			}
+			records = append(records, map[string]interface{}{"content": content, "disabled": false})
+		}
+		rrset["changetype"] = "REPLACE"
+		rrset["ttl"] = powerDNSTTL
+		rrset["records"] = records
+	}
+
+	_, err := powerDNSRequest(zone, "PATCH", powerDNSZonePath(zone), map[string]interface{}{
+		"rrsets": []interface{}{rrset},
+	})
+	return err
+}
+
+func writeJSONError(ctx *fasthttp.RequestCtx, statusCode int, message string) {
+	errData, _ := json.Marshal(map[string]string{"error": message})
+	ctx.SetStatusCode(statusCode)
+	ctx.SetContentType("application/json")
+	ctx.Write(errData)
+}
+
+// writeProviderError reports a failed DNS provider call. Transient failures
+// get 503 with Retry-After so clients retry soon instead of at the next cycle.
+func writeProviderError(ctx *fasthttp.RequestCtx, message string, err error) {
+	retryable, retryAfter := retryableError(err)
+	var mirrorErr *mirrorError
+	if errors.As(err, &mirrorErr) {
+		retryable, retryAfter = mirrorErr.Retryable, mirrorErr.RetryAfter
+	}
+
+	statusCode := fasthttp.StatusInternalServerError
+	if retryable {
+		statusCode = fasthttp.StatusServiceUnavailable
+		if retryAfter < defaultServerRetryAfter {
+			retryAfter = defaultServerRetryAfter
+		}
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+
+	response := map[string]interface{}{
+		"error":     fmt.Sprintf("%s: %v", message, err),
+		"retryable": retryable,
+	}
+	if statuses := mirrorStatuses(err); statuses != nil {
+		response["providers"] = statuses
+	}
+
+	errData, _ := json.Marshal(response)
+	ctx.SetStatusCode(statusCode)
+	ctx.SetContentType("application/json")
+	ctx.Write(errData)
+}
+
+func writeJSON(ctx *fasthttp.RequestCtx, value interface{}) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		writeJSONError(ctx, fasthttp.StatusInternalServerError, "Failed to marshal response")
+		return
+	}
+	ctx.SetContentType("application/json")
+	ctx.Write(data)
+}
+
+// requireAdmin checks the admin bearer token. Admin endpoints are disabled
+// unless admin_token is set in the server config.
+func requireAdmin(config *ServerConfig, ctx *fasthttp.RequestCtx) bool {
+	if config.AdminToken == "" {
+		writeJSONError(ctx, fasthttp.StatusNotFound, "Admin API disabled")
+		return false
+	}
+
+	auth := ctx.Request.Header.Peek("Authorization")
+	if subtle.ConstantTimeCompare(auth, []byte("Bearer "+config.AdminToken)) != 1 {
+		writeJSONError(ctx, fasthttp.StatusUnauthorized, "Invalid admin token")
+		return false
+	}
+
+	return true
+}
+
+const signedRequestMaxAge = 5 * time.Minute
+
+func verifySignedRequest(body []byte, action string) (*SignedPayload, int, error) {
+	var signedReq SignedRequest
+	if err := json.Unmarshal(body, &signedReq); err != nil {
+		return nil, fasthttp.StatusBadRequest, fmt.Errorf("Invalid request")
+	}
+
+	payloadData, err := base64.StdEncoding.DecodeString(signedReq.Data)
+	if err != nil {
+		return nil, fasthttp.StatusBadRequest, fmt.Errorf("Invalid request data")
+	}
+
+	var payload SignedPayload
+	if err := json.Unmarshal(payloadData, &payload); err != nil {
+		return nil, fasthttp.StatusBadRequest, fmt.Errorf("Invalid request data")
+	}
+
+	if payload.Action != action {
+		return nil, fasthttp.StatusBadRequest, fmt.Errorf("Action mismatch")
+	}
+
+	age := time.Since(time.Unix(payload.Timestamp, 0))
+	if age > signedRequestMaxAge || age < -signedRequestMaxAge {
+		return nil, fasthttp.StatusUnauthorized, fmt.Errorf("Request expired")
+	}
+
+	authorized, clientPublicKey, err := isAuthorizedDomain(payload.Domain)
+	if err != nil {
+		return nil, fasthttp.StatusInternalServerError, fmt.Errorf("Error checking authorization")
+	}
+	if !authorized {
+		return nil, fasthttp.StatusUnauthorized, fmt.Errorf("Domain not authorized")
+	}
+
+	clientPubKey, err := decodePublicKey(clientPublicKey)
+	if err != nil {
+		return nil, fasthttp.StatusInternalServerError, fmt.Errorf("Invalid client public key")
+	}
+
+	if !verifySignature(payloadData, signedReq.Signature, clientPubKey) {
+		return nil, fasthttp.StatusUnauthorized, fmt.Errorf("Invalid signature")
+	}
+
+	return &payload, fasthttp.StatusOK, nil
+}
+
+// signKeyRotation signs the server's public key with previous_privatekey,
+// which lets clients that pinned the old key move to the new one.
+func signKeyRotation(config *ServerConfig) (string, string, error) {
+	if config.PreviousPrivateKey == "" {
+		return "", "", nil
+	}
+
+	previousKey, err := decodePrivateKey(config.PreviousPrivateKey)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid previous_privatekey: %v", err)
+	}
+	previousPublicKey, err := encodePublicKey(&previousKey.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	signature, err := signData([]byte(config.PublicKey), previousKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	fmt.Printf("Serving key rotation from %s\n", serverKeyFingerprint(previousPublicKey))
+	return previousPublicKey, signature, nil
+}
+
+// forwardedClientIP returns the address a request came from. Behind a
+// reverse proxy listed in trusted_proxies, that is the last X-Forwarded-For
+// entry not added by a trusted proxy; the header is ignored otherwise, since
+// anyone can send it.
+func forwardedClientIP(remote net.IP, forwardedFor string, trusted []*net.IPNet) net.IP {
+	if !containsIP(trusted, remote) {
+		return remote
+	}
+
+	hops := strings.Split(forwardedFor, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !containsIP(trusted, ip) {
+			return ip
+		}
+		remote = ip
+	}
+	return remote
 }
 
 func startServer() {
@@ -181,10 +828,62 @@ func startServer() {
 		return
 	}
 
+	zones, err := newZoneRegistry(config)
+	if err != nil {
+		fmt.Printf("Error loading zones: %v\n", err)
+		return
+	}
+
+	if err := zones.verify(); err != nil {
+		fmt.Printf("Error verifying DNS provider: %v\n", err)
+		return
+	}
+
+	if err := zones.start(); err != nil {
+		fmt.Printf("Error starting DNS provider: %v\n", err)
+		return
+	}
+
+	state, err := loadServerState(config.StateFile)
+	if err != nil {
+		fmt.Printf("Error loading server state: %v\n", err)
+		return
+	}
+
+	previousPublicKey, keySignature, err := signKeyRotation(config)
+	if err != nil {
+		fmt.Printf("Error signing key rotation: %v\n", err)
+		return
+	}
+
+	trustedProxies, err := parseNetworks(config.TrustedProxies)
+	if err != nil {
+		fmt.Printf("Error loading config: invalid trusted_proxies: %v\n", err)
+		return
+	}
+
+	drift := newDriftDetector(config, zones, state)
+	if config.DriftCheckInterval > 0 {
+		fmt.Printf("Checking DNS records for drift every %s (policy: %s)\n", time.Duration(config.DriftCheckInterval), config.DriftPolicy)
+		go drift.run(time.Duration(config.DriftCheckInterval))
+	}
+
+	if config.OrphanCheckInterval > 0 {
+		fmt.Printf("Checking for orphan DNS records every %s (policy: %s)\n", time.Duration(config.OrphanCheckInterval), config.OrphanPolicy)
+		go runOrphanReconciler(config, zones, state, time.Duration(config.OrphanCheckInterval))
+	}
+
 	fmt.Printf("Server starting on %s\n", config.Listen)
 
 	router := ming.New()
 
+	// /ip tells clients the address they connect from, as an IP source that
+	// does not depend on third-party services.
+	router.Get("/ip", func(ctx *fasthttp.RequestCtx) {
+		ip := forwardedClientIP(ctx.RemoteIP(), string(ctx.Request.Header.Peek("X-Forwarded-For")), trustedProxies)
+		writeJSON(ctx, map[string]string{"ip": ip.String()})
+	})
+
 	router.Post("/verify", func(ctx *fasthttp.RequestCtx) {
 		var verifyReq VerifyRequest
 		if err := json.Unmarshal(ctx.PostBody(), &verifyReq); err != nil {
@@ -199,6 +898,9 @@ func startServer() {
 			ProxySSL:  verifyReq.ProxySSL,
 			IP:        verifyReq.IP,
 			PublicKey: config.PublicKey,
+
+			PreviousPublicKey: previousPublicKey,
+			KeySignature:      keySignature,
 		}
 
 		authorized, clientPublicKey, err := isAuthorizedDomain(verifyReq.Domain)
@@ -292,33 +994,126 @@ func startServer() {
 			return
 		}
 
-		currentRecord, err := getCloudflareRecord(config, registerData.Domain)
+		ip := net.ParseIP(registerData.IP)
+		if ip == nil {
+			writeJSONError(ctx, fasthttp.StatusBadRequest, "Invalid IP address")
+			return
+		}
+		recordType := "A"
+		if ip.To4() == nil {
+			recordType = "AAAA"
+		}
+
+		provider, err := zones.lookup(registerData.Domain)
 		if err != nil {
-			fmt.Printf("Error checking DNS record for %s: %v\n", registerData.Domain, err)
+			fmt.Printf("Error finding zone for %s: %v\n", registerData.Domain, err)
 			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
 			ctx.SetContentType("application/json")
-			ctx.WriteString(fmt.Sprintf(`{"error": "Failed to check DNS record: %v"}`, err))
+			ctx.WriteString(`{"error": "No DNS zone configured for domain"}`)
 			return
 		}
 
-		if currentRecord == nil || currentRecord.Content != registerData.IP {
-			err = updateCloudflareRecord(config, registerData.Domain, registerData.IP, registerData.ProxySSL)
-			if err != nil {
-				fmt.Printf("Error updating DNS record for %s -> %s: %v\n", registerData.Domain, registerData.IP, err)
-				ctx.SetStatusCode(fasthttp.StatusInternalServerError)
-				ctx.SetContentType("application/json")
-				ctx.WriteString(fmt.Sprintf(`{"error": "Failed to update DNS record: %v"}`, err))
-				return
-			}
+		// Mirrored zones retry each provider on their own and report how
+		// each one did.
+		var updated bool
+		var statuses []providerStatus
+		if mirror, ok := provider.(*mirrorProvider); ok {
+			updated, statuses, err = mirror.setRecordStatus(registerData.Domain, recordType, registerData.IP, registerData.ProxySSL)
+		} else {
+			err = withRetry(config.Retry, "DNS update for "+registerData.Domain, func() error {
+				updated, err = provider.SetRecord(registerData.Domain, recordType, registerData.IP, registerData.ProxySSL)
+				return err
+			})
+		}
+		if err != nil {
+			fmt.Printf("Error updating DNS record for %s -> %s: %v\n", registerData.Domain, registerData.IP, err)
+			writeProviderError(ctx, "Failed to update DNS record", err)
+			return
+		}
+
+		if updated {
 			fmt.Printf("Updated DNS record: %s -> %s\n", registerData.Domain, registerData.IP)
 		} else {
 			fmt.Printf("DNS record already up to date: %s -> %s\n", registerData.Domain, registerData.IP)
 		}
 
+		if err := state.setRecord(registerData.Domain, recordType, registerData.IP, registerData.ProxySSL); err != nil {
+			fmt.Printf("Error saving server state: %v\n", err)
+		}
+
+		if statuses != nil {
+			writeJSON(ctx, map[string]interface{}{"status": "success", "updated": updated, "providers": statuses})
+			return
+		}
+
+		writeJSON(ctx, map[string]interface{}{"status": "success", "updated": updated})
+	})
+
+	router.Post("/unregister", func(ctx *fasthttp.RequestCtx) {
+		payload, status, err := verifySignedRequest(ctx.PostBody(), "unregister")
+		if err != nil {
+			writeJSONError(ctx, status, err.Error())
+			return
+		}
+
+		provider, err := zones.lookup(payload.Domain)
+		if err != nil {
+			fmt.Printf("Error finding zone for %s: %v\n", payload.Domain, err)
+			writeJSONError(ctx, fasthttp.StatusInternalServerError, "No DNS zone configured for domain")
+			return
+		}
+
+		err = withRetry(config.Retry, "DNS delete for "+payload.Domain, func() error {
+			for _, recordType := range []string{"A", "AAAA"} {
+				if err := provider.DeleteRecords(payload.Domain, recordType, ""); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Printf("Error deleting DNS records for %s: %v\n", payload.Domain, err)
+			writeProviderError(ctx, "Failed to delete DNS records", err)
+			return
+		}
+		fmt.Printf("Deleted DNS records: %s\n", payload.Domain)
+
+		if err := state.removeDomain(payload.Domain); err != nil {
+			fmt.Printf("Error saving server state: %v\n", err)
+		}
+
 		ctx.SetContentType("application/json")
 		ctx.WriteString(`{"status": "success"}`)
 	})
 
+	router.Get("/admin/drift", func(ctx *fasthttp.RequestCtx) {
+		if !requireAdmin(config, ctx) {
+			return
+		}
+
+		result := drift.lastResult()
+		if result == nil || string(ctx.QueryArgs().Peek("refresh")) == "1" {
+			result = drift.check()
+		}
+		writeJSON(ctx, result)
+	})
+
+	router.Get("/admin/orphans", func(ctx *fasthttp.RequestCtx) {
+		if !requireAdmin(config, ctx) {
+			return
+		}
+
+		result, err := reconcileOrphans(config, zones, state, false)
+		if err != nil {
+			writeJSONError(ctx, fasthttp.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(ctx, result)
+	})
+
+	router.Post("/acme/present", handleACMEPresent(config, zones))
+	router.Post("/acme/cleanup", handleACMECleanup(config, zones))
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
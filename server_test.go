@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCloudflare runs the fake Cloudflare API and records the auth headers
+// of every request it receives.
+type testCloudflare struct {
+	*fakeCloudflare
+	server *httptest.Server
+
+	mu      sync.Mutex
+	headers []http.Header
+}
+
+func newTestCloudflare(t *testing.T) *testCloudflare {
+	t.Helper()
+	tc := &testCloudflare{fakeCloudflare: newFakeCloudflare()}
+	tc.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc.mu.Lock()
+		tc.headers = append(tc.headers, r.Header.Clone())
+		tc.mu.Unlock()
+		tc.fakeCloudflare.ServeHTTP(w, r)
+	}))
+	t.Cleanup(tc.server.Close)
+	return tc
+}
+
+func (tc *testCloudflare) zone(zoneID string) *ZoneConfig {
+	return &ZoneConfig{
+		CloudflareAPI: tc.server.URL + "/client/v4",
+		AuthType:      "token",
+		AuthKey:       "test-token",
+		ZoneID:        zoneID,
+	}
+}
+
+func (tc *testCloudflare) stored(zoneID, name, recordType string) []fakeCloudflareRecord {
+	tc.fakeCloudflare.mu.Lock()
+	defer tc.fakeCloudflare.mu.Unlock()
+
+	var records []fakeCloudflareRecord
+	for _, record := range tc.records[zoneID] {
+		if record.Name == name && record.Type == recordType {
+			records = append(records, *record)
+		}
+	}
+	return records
+}
+
+func (tc *testCloudflare) callCount(prefix string) int {
+	tc.fakeCloudflare.mu.Lock()
+	defer tc.fakeCloudflare.mu.Unlock()
+
+	count := 0
+	for _, call := range tc.calls {
+		if strings.HasPrefix(call, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestCloudflareRecordsPagination(t *testing.T) {
+	tc := newTestCloudflare(t)
+	total := cloudflarePageSize*2 + 50
+	for i := 0; i < total; i++ {
+		tc.seedRecord("zone1", fakeCloudflareRecord{Type: "A", Name: fmt.Sprintf("host%d.vozdns.vn", i), Content: "203.0.113.1"})
+	}
+
+	records, err := getCloudflareRecords(tc.zone("zone1"), "", "")
+	if err != nil {
+		t.Fatalf("getCloudflareRecords: %v", err)
+	}
+	if len(records) != total {
+		t.Fatalf("got %d records, want %d", len(records), total)
+	}
+	if pages := tc.callCount("GET /client/v4/zones/zone1/dns_records"); pages != 3 {
+		t.Errorf("fetched %d pages, want 3", pages)
+	}
+}
+
+func TestCloudflareSetRecord(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []fakeCloudflareRecord
+		proxied  bool
+		updated  bool
+	}{
+		{name: "create", updated: true},
+		{name: "up to date", existing: []fakeCloudflareRecord{{Content: "203.0.113.7"}}},
+		{name: "new IP", existing: []fakeCloudflareRecord{{Content: "203.0.113.1"}}, updated: true},
+		{name: "proxied changed", existing: []fakeCloudflareRecord{{Content: "203.0.113.7"}}, proxied: true, updated: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tc := newTestCloudflare(t)
+			for _, record := range test.existing {
+				record.Type, record.Name = "A", "home.vozdns.vn"
+				tc.seedRecord("zone1", record)
+			}
+
+			updated, err := newCloudflareProvider(tc.zone("zone1")).SetRecord("home.vozdns.vn", "A", "203.0.113.7", test.proxied)
+			if err != nil {
+				t.Fatalf("SetRecord: %v", err)
+			}
+			if updated != test.updated {
+				t.Errorf("updated = %v, want %v", updated, test.updated)
+			}
+
+			records := tc.stored("zone1", "home.vozdns.vn", "A")
+			if len(records) != 1 || records[0].Content != "203.0.113.7" || records[0].Proxied != test.proxied {
+				t.Errorf("stored records = %+v", records)
+			}
+		})
+	}
+}
+
+func TestCloudflareDuplicatePolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   int
+	}{
+		{policy: "delete", want: 1},
+		{policy: "report", want: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			tc := newTestCloudflare(t)
+			for _, content := range []string{"203.0.113.1", "203.0.113.7", "203.0.113.9"} {
+				tc.seedRecord("zone1", fakeCloudflareRecord{Type: "A", Name: "home.vozdns.vn", Content: content})
+			}
+
+			zone := tc.zone("zone1")
+			zone.DuplicatePolicy = test.policy
+			if _, err := newCloudflareProvider(zone).SetRecord("home.vozdns.vn", "A", "203.0.113.7", false); err != nil {
+				t.Fatalf("SetRecord: %v", err)
+			}
+
+			records := tc.stored("zone1", "home.vozdns.vn", "A")
+			if len(records) != test.want {
+				t.Fatalf("got %d records, want %d: %+v", len(records), test.want, records)
+			}
+			// The record that already had the right content is the one kept.
+			if test.policy == "delete" && records[0].ID != "fake000002" {
+				t.Errorf("kept %s, want fake000002", records[0].ID)
+			}
+			if calls := tc.callCount("PUT "); calls != 0 {
+				t.Errorf("made %d PUT calls, want 0", calls)
+			}
+		})
+	}
+}
+
+func TestCloudflareAuthHeaders(t *testing.T) {
+	tests := []struct {
+		authType string
+		want     map[string]string
+		absent   []string
+	}{
+		{
+			authType: "token",
+			want:     map[string]string{"Authorization": "Bearer secret"},
+			absent:   []string{"X-Auth-Email", "X-Auth-Key"},
+		},
+		{
+			authType: "global_key",
+			want:     map[string]string{"X-Auth-Email": "admin@vozdns.vn", "X-Auth-Key": "secret"},
+			absent:   []string{"Authorization"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.authType, func(t *testing.T) {
+			tc := newTestCloudflare(t)
+			zone := tc.zone("zone1")
+			zone.AuthType = test.authType
+			zone.AuthEmail = "admin@vozdns.vn"
+			zone.AuthKey = "secret"
+
+			if err := newCloudflareProvider(zone).Verify(); err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+
+			tc.mu.Lock()
+			defer tc.mu.Unlock()
+			if len(tc.headers) == 0 {
+				t.Fatal("no requests made")
+			}
+			for _, header := range tc.headers {
+				for key, value := range test.want {
+					if got := header.Get(key); got != value {
+						t.Errorf("%s = %q, want %q", key, got, value)
+					}
+				}
+				for _, key := range test.absent {
+					if header.Get(key) != "" {
+						t.Errorf("unexpected %s header", key)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCloudflareVerifyRejectsUnknownAuthType(t *testing.T) {
+	tc := newTestCloudflare(t)
+	zone := tc.zone("zone1")
+	zone.AuthType = "password"
+	if err := newCloudflareProvider(zone).Verify(); err == nil {
+		t.Fatal("Verify accepted an unknown auth_type")
+	}
+}
+
+func TestCloudflareZoneIDDiscovery(t *testing.T) {
+	tc := newTestCloudflare(t)
+	zone := tc.zone("")
+	zone.Name = "vozdns.vn"
+	tc.seedRecord("vozdns.vn", fakeCloudflareRecord{Type: "A", Name: "home.vozdns.vn", Content: "203.0.113.7"})
+
+	provider := newCloudflareProvider(zone)
+	records, err := provider.Records("home.vozdns.vn", "A")
+	if err != nil {
+		t.Fatalf("Records: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	if zone.ZoneID != "vozdns.vn" {
+		t.Errorf("zone ID = %q, want vozdns.vn", zone.ZoneID)
+	}
+
+	// The discovered ID is cached.
+	if _, err := provider.Records("home.vozdns.vn", "A"); err != nil {
+		t.Fatalf("Records: %v", err)
+	}
+	if lookups := tc.callCount("GET /client/v4/zones?name="); lookups != 1 {
+		t.Errorf("looked up the zone %d times, want 1", lookups)
+	}
+}
+
+func TestCloudflareZoneIDRequired(t *testing.T) {
+	tc := newTestCloudflare(t)
+	if _, err := newCloudflareProvider(tc.zone("")).Records("home.vozdns.vn", "A"); err == nil {
+		t.Fatal("Records worked without a zone ID or name")
+	}
+}
+
+func TestCloudflareRateLimitRetry(t *testing.T) {
+	tc := newTestCloudflare(t)
+	tc.injectFault(http.StatusTooManyRequests, 1, 1)
+
+	provider := newCloudflareProvider(tc.zone("zone1"))
+	policy := RetryConfig{InitialBackoff: Duration(time.Millisecond), Deadline: Duration(10 * time.Second)}
+
+	start := time.Now()
+	err := withRetry(policy, "test", func() error {
+		_, err := provider.SetRecord("home.vozdns.vn", "A", "203.0.113.7", false)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("withRetry: %v", err)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("retried after %s, want at least the 1s Retry-After", waited)
+	}
+	if records := tc.stored("zone1", "home.vozdns.vn", "A"); len(records) != 1 {
+		t.Errorf("got %d records after retry, want 1", len(records))
+	}
+}
+
+func TestCloudflareErrorsRetryable(t *testing.T) {
+	tests := []struct {
+		status    int
+		retryable bool
+	}{
+		{status: http.StatusTooManyRequests, retryable: true},
+		{status: http.StatusBadGateway, retryable: true},
+		{status: http.StatusForbidden, retryable: false},
+		{status: http.StatusBadRequest, retryable: false},
+	}
+
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			tc := newTestCloudflare(t)
+			tc.injectFault(test.status, 10, 0)
+
+			policy := RetryConfig{MaxAttempts: 1}
+			err := withRetry(policy, "test", func() error {
+				_, err := newCloudflareProvider(tc.zone("zone1")).Records("home.vozdns.vn", "A")
+				return err
+			})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if retryable, _ := retryableError(err); retryable != test.retryable {
+				t.Errorf("retryable = %v, want %v", retryable, test.retryable)
+			}
+		})
+	}
+}
+
+func TestCloudflareRetryGivesUpPastDeadline(t *testing.T) {
+	tc := newTestCloudflare(t)
+	tc.injectFault(http.StatusTooManyRequests, 10, 60)
+
+	policy := RetryConfig{Deadline: Duration(time.Second)}
+	start := time.Now()
+	err := withRetry(policy, "test", func() error {
+		_, err := newCloudflareProvider(tc.zone("zone1")).Records("home.vozdns.vn", "A")
+		return err
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("waited past the deadline")
+	}
+	if _, retryAfter := retryableError(err); retryAfter != time.Minute {
+		t.Errorf("retryAfter = %s, want 1m", retryAfter)
+	}
+}
+
+func TestCloudflareZoneName(t *testing.T) {
+	tc := newTestCloudflare(t)
+	provider := newCloudflareProvider(tc.zone("vozdns.vn"))
+
+	for i := 0; i < 2; i++ {
+		name, err := provider.ZoneName()
+		if err != nil {
+			t.Fatalf("ZoneName: %v", err)
+		}
+		if name != "vozdns.vn" {
+			t.Errorf("name = %q, want vozdns.vn", name)
+		}
+	}
+	if lookups := tc.callCount("GET /client/v4/zones/vozdns.vn"); lookups != 1 {
+		t.Errorf("looked up the zone %d times, want 1", lookups)
+	}
+}
+
+// testPowerDNS runs the fake PowerDNS API and records the body of every
+// PATCH it receives.
+type testPowerDNS struct {
+	*fakePowerDNS
+	server *httptest.Server
+
+	mu      sync.Mutex
+	patches []fakePowerDNSRRset
+}
+
+func newTestPowerDNS(t *testing.T) *testPowerDNS {
+	t.Helper()
+	tp := &testPowerDNS{fakePowerDNS: newFakePowerDNS()}
+	tp.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			body, _ := io.ReadAll(r.Body)
+			var patch struct {
+				RRsets []fakePowerDNSRRset `json:"rrsets"`
+			}
+			if err := json.Unmarshal(body, &patch); err != nil {
+				t.Errorf("invalid PATCH body: %v", err)
+			}
+			tp.mu.Lock()
+			tp.patches = append(tp.patches, patch.RRsets...)
+			tp.mu.Unlock()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		tp.fakePowerDNS.ServeHTTP(w, r)
+	}))
+	t.Cleanup(tp.server.Close)
+	return tp
+}
+
+func (tp *testPowerDNS) provider(t *testing.T) *powerDNSProvider {
+	t.Helper()
+	p, err := newPowerDNSProvider(&ZoneConfig{Name: "vozdns.vn", PowerDNSAPI: tp.server.URL, AuthKey: "secret"})
+	if err != nil {
+		t.Fatalf("newPowerDNSProvider: %v", err)
+	}
+	return p
+}
+
+func (tp *testPowerDNS) lastPatch(t *testing.T) fakePowerDNSRRset {
+	t.Helper()
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if len(tp.patches) == 0 {
+		t.Fatal("no PATCH was sent")
+	}
+	return tp.patches[len(tp.patches)-1]
+}
+
+func (tp *testPowerDNS) patchCount() int {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return len(tp.patches)
+}
+
+func rrsetContents(rrset fakePowerDNSRRset) []string {
+	var contents []string
+	for _, record := range rrset.Records {
+		contents = append(contents, record.Content)
+	}
+	return contents
+}
+
+func TestPowerDNSSetRecord(t *testing.T) {
+	tp := newTestPowerDNS(t)
+	p := tp.provider(t)
+
+	updated, err := p.SetRecord("Home.vozdns.vn", "A", "203.0.113.7", false)
+	if err != nil {
+		t.Fatalf("SetRecord: %v", err)
+	}
+	if !updated {
+		t.Error("updated = false for a new record")
+	}
+
+	rrset := tp.lastPatch(t)
+	if rrset.ChangeType != "REPLACE" || rrset.Name != "home.vozdns.vn." || rrset.Type != "A" || rrset.TTL != powerDNSTTL {
+		t.Errorf("PATCH rrset = %+v", rrset)
+	}
+	if contents := rrsetContents(rrset); len(contents) != 1 || contents[0] != "203.0.113.7" {
+		t.Errorf("PATCH contents = %v", contents)
+	}
+
+	updated, err = p.SetRecord("home.vozdns.vn", "A", "203.0.113.7", false)
+	if err != nil {
+		t.Fatalf("SetRecord: %v", err)
+	}
+	if updated || tp.patchCount() != 1 {
+		t.Errorf("unchanged record was patched again")
+	}
+}
+
+func TestPowerDNSAddAndDeleteRecords(t *testing.T) {
+	tp := newTestPowerDNS(t)
+	p := tp.provider(t)
+	name := "_acme-challenge.home.vozdns.vn"
+
+	for _, content := range []string{"token-one", `token "two"`} {
+		if err := p.AddRecord(name, "TXT", content); err != nil {
+			t.Fatalf("AddRecord: %v", err)
+		}
+	}
+	rrset := tp.lastPatch(t)
+	if rrset.ChangeType != "REPLACE" || rrset.Type != "TXT" {
+		t.Errorf("PATCH rrset = %+v", rrset)
+	}
+	want := []string{`"token \"two\""`, `"token-one"`}
+	if contents := rrsetContents(rrset); !reflect.DeepEqual(contents, want) {
+		t.Errorf("PATCH contents = %v, want %v", contents, want)
+	}
+
+	records, err := p.Records(name, "TXT")
+	if err != nil {
+		t.Fatalf("Records: %v", err)
+	}
+	if len(records) != 2 || records[0].Content != `token "two"` {
+		t.Errorf("records = %+v, want the TXT contents unquoted", records)
+	}
+
+	if err := p.DeleteRecords(name, "TXT", "token-one"); err != nil {
+		t.Fatalf("DeleteRecords: %v", err)
+	}
+	rrset = tp.lastPatch(t)
+	if rrset.ChangeType != "REPLACE" || !reflect.DeepEqual(rrsetContents(rrset), []string{`"token \"two\""`}) {
+		t.Errorf("PATCH rrset = %+v, want a REPLACE with the other token", rrset)
+	}
+
+	if err := p.DeleteRecords(name, "TXT", ""); err != nil {
+		t.Fatalf("DeleteRecords: %v", err)
+	}
+	rrset = tp.lastPatch(t)
+	if rrset.ChangeType != "DELETE" || rrset.Name != name+"." || len(rrset.Records) != 0 {
+		t.Errorf("PATCH rrset = %+v, want a DELETE", rrset)
+	}
+
+	patches := tp.patchCount()
+	if err := p.DeleteRecords(name, "TXT", ""); err != nil {
+		t.Fatalf("DeleteRecords: %v", err)
+	}
+	if tp.patchCount() != patches {
+		t.Error("deleting a missing RRset sent a PATCH")
+	}
+}
+
+func TestPowerDNSErrorsRetryable(t *testing.T) {
+	tests := []struct {
+		status    int
+		retryable bool
+	}{
+		{status: http.StatusTooManyRequests, retryable: true},
+		{status: http.StatusInternalServerError, retryable: true},
+		{status: http.StatusServiceUnavailable, retryable: true},
+		{status: http.StatusUnauthorized, retryable: false},
+		{status: http.StatusNotFound, retryable: false},
+		{status: http.StatusUnprocessableEntity, retryable: false},
+	}
+
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			tp := newTestPowerDNS(t)
+			tp.injectFault(test.status, 1, 0)
+
+			_, err := tp.provider(t).SetRecord("home.vozdns.vn", "A", "203.0.113.7", false)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if retryable, _ := retryableError(err); retryable != test.retryable {
+				t.Errorf("retryable = %v, want %v", retryable, test.retryable)
+			}
+		})
+	}
+}
+
+func TestPowerDNSRejectsOutOfZoneName(t *testing.T) {
+	tp := newTestPowerDNS(t)
+	_, err := tp.provider(t).SetRecord("home.example.com", "A", "203.0.113.7", false)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if retryable, _ := retryableError(err); retryable {
+		t.Error("a 422 was treated as retryable")
+	}
+}
+
+func TestForwardedClientIP(t *testing.T) {
+	trusted, err := parseNetworks([]string{"127.0.0.1", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("parseNetworks: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		remote       string
+		forwardedFor string
+		want         string
+	}{
+		{name: "direct", remote: "203.0.113.7", want: "203.0.113.7"},
+		{name: "untrusted remote sends the header", remote: "203.0.113.7", forwardedFor: "198.51.100.1", want: "203.0.113.7"},
+		{name: "trusted proxy", remote: "127.0.0.1", forwardedFor: "203.0.113.7", want: "203.0.113.7"},
+		{name: "spoofed first hop", remote: "127.0.0.1", forwardedFor: "198.51.100.1, 203.0.113.7", want: "203.0.113.7"},
+		{name: "chain of trusted proxies", remote: "127.0.0.1", forwardedFor: "203.0.113.7, 10.0.0.2", want: "203.0.113.7"},
+		{name: "trusted proxy without header", remote: "127.0.0.1", want: "127.0.0.1"},
+		{name: "garbage header", remote: "127.0.0.1", forwardedFor: "unknown", want: "127.0.0.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := forwardedClientIP(net.ParseIP(test.remote), test.forwardedFor, trusted)
+			if got.String() != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+// newTestClient returns a client config for domain with a fresh key pair.
+func newTestClient(t *testing.T, domain string) *ClientConfig {
+	t.Helper()
+	privateKey, publicKey, err := generateECCKeyPair()
+	if err != nil {
+		t.Fatalf("generateECCKeyPair: %v", err)
+	}
+	encodedPrivate, err := encodePrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("encodePrivateKey: %v", err)
+	}
+	encodedPublic, err := encodePublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("encodePublicKey: %v", err)
+	}
+	return &ClientConfig{Domain: domain, PrivateKey: encodedPrivate, PublicKey: encodedPublic}
+}
+
+// useAuthorizedDomains serves subdomain.json with the given clients for the
+// rest of the test.
+func useAuthorizedDomains(t *testing.T, clients ...*ClientConfig) {
+	t.Helper()
+	var domains []AuthorizedDomain
+	for _, client := range clients {
+		domains = append(domains, AuthorizedDomain{Domain: client.Domain, PublicKey: client.PublicKey})
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(domains)
+	}))
+	t.Cleanup(server.Close)
+
+	previous := authorizedDomainsURL
+	authorizedDomainsURL = server.URL
+	t.Cleanup(func() { authorizedDomainsURL = previous })
+}
+
+func newTestDryRunZones(t *testing.T) (*ServerConfig, *zoneRegistry) {
+	t.Helper()
+	config := &ServerConfig{ZoneConfig: ZoneConfig{Provider: "dryrun"}, Retry: RetryConfig{MaxAttempts: 1}}
+	zones, err := newZoneRegistry(config)
+	if err != nil {
+		t.Fatalf("newZoneRegistry: %v", err)
+	}
+	return config, zones
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serverDiscoveryURL = "https://vozdns.vn/server.json"
+	maxServerInfoSize  = 64 * 1024
+
+	// serverRequestTimeout leaves the server its whole retry deadline plus
+	// a last provider attempt of a few providerRequestTimeout calls before
+	// the client gives up on it.
+	serverRequestTimeout = 2 * maxRetryDeadline
+)
+
+// discoveryPublicKey verifies server.json. It is set at build time with
+// -ldflags "-X main.discoveryPublicKey=<key>"; the matching private key is
+// kept offline by the maintainers, see -generate-discovery-key.
+var discoveryPublicKey = ""
+
+// defaultDiscoveryValidity is how long a signed server.json is accepted, so
+// an old signed list cannot be replayed forever.
+const defaultDiscoveryValidity = 90 * 24 * time.Hour
+
+var serverHTTPClient = &http.Client{Timeout: serverRequestTimeout}
+
+// ServerEntry is one server listed in server.json. Lower priorities are
+// tried first; servers with the same priority share the load by weight.
+// PublicKey is the server's key, which /verify must return.
+type ServerEntry struct {
+	URL       string `json:"url"`
+	Priority  int    `json:"priority,omitempty"`
+	Weight    int    `json:"weight,omitempty"`
+	PublicKey string `json:"publickey,omitempty"`
+}
+
+// signedServerInfo is the published server.json: a ServerInfo signed with
+// the discovery key. Server is left outside the signature for clients that
+// predate signing and is ignored here.
+type signedServerInfo struct {
+	Server    string `json:"server,omitempty"`
+	Data      string `json:"data"`
+	Signature string `json:"signature"`
+}
+
+func getServerInfo() (*ServerInfo, error) {
+	resp, err := serverHTTPClient.Get(serverDiscoveryURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxServerInfoSize))
+	if err != nil {
+		return nil, err
+	}
+
+	serverInfo, err := verifyServerInfo(body, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDiscoveryVersion(serverInfo.Version); err != nil {
+		return nil, err
+	}
+	return serverInfo, nil
+}
+
+// verifyServerInfo checks the signature on server.json and that the signed
+// list has not expired at now.
+func verifyServerInfo(body []byte, now time.Time) (*ServerInfo, error) {
+	var signed signedServerInfo
+	if err := json.Unmarshal(body, &signed); err != nil {
+		return nil, err
+	}
+	if discoveryPublicKey == "" {
+		return legacyServerInfo(&signed)
+	}
+	if signed.Data == "" || signed.Signature == "" {
+		return nil, fmt.Errorf("server info is not signed")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(signed.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server info data: %v", err)
+	}
+
+	publicKey, err := decodePublicKey(discoveryPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid discovery public key: %v", err)
+	}
+	if !verifySignature(data, signed.Signature, publicKey) {
+		return nil, fmt.Errorf("invalid server info signature")
+	}
+
+	var serverInfo ServerInfo
+	if err := json.Unmarshal(data, &serverInfo); err != nil {
+		return nil, err
+	}
+	if serverInfo.Expires.IsZero() || now.After(serverInfo.Expires) {
+		return nil, fmt.Errorf("server info expired at %s", serverInfo.Expires.Format(time.RFC3339))
+	}
+
+	return &serverInfo, nil
+}
+
+var legacyDiscoveryWarning sync.Once
+
+// legacyServerInfo uses the unsigned "server" field of server.json. Builds
+// without a discovery public key fall back to it, so releases made before the
+// maintainers publish a signed server.json keep working; since anyone who can
+// change server.json can redirect them, a warning is logged.
+func legacyServerInfo(signed *signedServerInfo) (*ServerInfo, error) {
+	if signed.Server == "" {
+		return nil, fmt.Errorf("this build has no discovery public key and server info has no \"server\" entry, set \"servers\" in the client config")
+	}
+	legacyDiscoveryWarning.Do(func() {
+		fmt.Println("Warning: this build has no discovery public key, server.json is not verified")
+	})
+	return &ServerInfo{Server: signed.Server}, nil
+}
+
+const discoveryVersionFileName = "discovery-version"
+
+// discoveryVersion is the highest server.json version this client has
+// accepted, kept in the state dir so an older signed list cannot be served
+// to it again.
+var discoveryVersion struct {
+	sync.Mutex
+	loaded bool
+	seen   int64
+}
+
+func checkDiscoveryVersion(version int64) error {
+	discoveryVersion.Lock()
+	defer discoveryVersion.Unlock()
+
+	stateDir, err := getStateDir()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(stateDir, discoveryVersionFileName)
+
+	if !discoveryVersion.loaded {
+		if data, err := os.ReadFile(path); err == nil {
+			discoveryVersion.seen, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		}
+		discoveryVersion.loaded = true
+	}
+
+	if version < discoveryVersion.seen {
+		return fmt.Errorf("server info version %d is older than version %d seen before", version, discoveryVersion.seen)
+	}
+	if version > discoveryVersion.seen {
+		discoveryVersion.seen = version
+		if err := writeFileAtomic(path, []byte(strconv.FormatInt(version, 10)+"\n"), 0600); err != nil {
+			fmt.Printf("Warning: failed to save the server info version: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// serverList returns the servers to try, in order. The servers set in the
+// client config are used as they are and skip discovery.
+func serverList(config *ClientConfig) ([]ServerEntry, error) {
+	if len(config.Servers) > 0 {
+		var servers []ServerEntry
+		for _, server := range config.Servers {
+			servers = append(servers, ServerEntry{URL: strings.TrimSuffix(server, "/")})
+		}
+		return servers, nil
+	}
+
+	serverInfo, err := getServerInfo()
+	if err != nil {
+		return nil, fmt.Errorf("error getting server info: %v", err)
+	}
+
+	entries := serverInfo.Servers
+	if len(entries) == 0 && serverInfo.Server != "" {
+		entries = []ServerEntry{{URL: serverInfo.Server}}
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("server info lists no servers")
+	}
+
+	servers := orderServers(entries)
+	for i := range servers {
+		servers[i].URL = strings.TrimSuffix(servers[i].URL, "/")
+	}
+	return servers, nil
+}
+
+// orderServers sorts by priority and shuffles each priority group by weight,
+// the same way SRV records are used.
+func orderServers(entries []ServerEntry) []ServerEntry {
+	byPriority := make(map[int][]ServerEntry)
+	var priorities []int
+	for _, entry := range entries {
+		if entry.URL == "" {
+			continue
+		}
+		if _, ok := byPriority[entry.Priority]; !ok {
+			priorities = append(priorities, entry.Priority)
+		}
+		byPriority[entry.Priority] = append(byPriority[entry.Priority], entry)
+	}
+	sort.Ints(priorities)
+
+	var ordered []ServerEntry
+	for _, priority := range priorities {
+		group := byPriority[priority]
+		for len(group) > 0 {
+			total := 0
+			for _, entry := range group {
+				total += serverWeight(entry)
+			}
+			pick := rand.Intn(total)
+			i := 0
+			for ; pick >= serverWeight(group[i]); i++ {
+				pick -= serverWeight(group[i])
+			}
+			ordered = append(ordered, group[i])
+			group = append(group[:i:i], group[i+1:]...)
+		}
+	}
+	return ordered
+}
+
+func serverWeight(entry ServerEntry) int {
+	if entry.Weight <= 0 {
+		return 1
+	}
+	return entry.Weight
+}
+
+// withServers calls fn with each server in turn until one of them handles
+// the request. It moves on to the next server when one cannot be reached or
+// fails with a 5xx; answers that would be the same on every server, such as
+// an unauthorized domain or a DNS provider failure, are returned as is.
+func withServers(config *ClientConfig, fn func(server ServerEntry) error) error {
+	servers, err := serverList(config)
+	if err != nil {
+		return err
+	}
+
+	for i, server := range servers {
+		err = fn(server)
+		if err == nil || !shouldFailover(err) {
+			return err
+		}
+		if i < len(servers)-1 {
+			fmt.Printf("Server %s failed: %v, trying %s\n", server.URL, err, servers[i+1].URL)
+		}
+	}
+	return err
+}
+
+func shouldFailover(err error) bool {
+	var serverErr *serverError
+	if errors.As(err, &serverErr) {
+		return serverErr.Status >= 500 && !serverErr.Retryable
+	}
+	return true
+}
+
+// signDiscovery signs the ServerInfo in path with the discovery private key
+// in keyPath and prints the server.json to publish. Messages go to stderr so
+// the output can be redirected straight to server.json.
+func signDiscovery(path, keyPath string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", path, err)
+		os.Exit(1)
+	}
+
+	var serverInfo ServerInfo
+	if err := json.Unmarshal(data, &serverInfo); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid server info %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	if len(serverInfo.Servers) == 0 {
+		fmt.Fprintln(os.Stderr, "The server list needs a \"servers\" array")
+		os.Exit(1)
+	}
+	for _, server := range serverInfo.Servers {
+		if server.URL == "" || server.PublicKey == "" {
+			fmt.Fprintln(os.Stderr, "Every server needs a url and the publickey from its config.json")
+			os.Exit(1)
+		}
+		if _, err := decodePublicKey(server.PublicKey); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid publickey for %s: %v\n", server.URL, err)
+			os.Exit(1)
+		}
+	}
+
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading discovery key: %v\n", err)
+		os.Exit(1)
+	}
+	privateKey, err := decodePrivateKey(strings.TrimSpace(string(keyData)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid discovery key: %v\n", err)
+		os.Exit(1)
+	}
+
+	publicKey, err := encodePublicKey(&privateKey.PublicKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding public key: %v\n", err)
+		os.Exit(1)
+	}
+	if publicKey != discoveryPublicKey {
+		fmt.Fprintln(os.Stderr, "Warning: this key does not match the discovery key built into this binary")
+	}
+
+	// Every signed list gets a newer version and an expiry, so clients
+	// refuse an old list replayed to them.
+	if serverInfo.Version == 0 {
+		serverInfo.Version = time.Now().Unix()
+	}
+	if serverInfo.Expires.IsZero() {
+		serverInfo.Expires = time.Now().Add(defaultDiscoveryValidity).UTC().Truncate(time.Second)
+	}
+	fmt.Fprintf(os.Stderr, "Signed version %d, expires %s\n", serverInfo.Version, serverInfo.Expires.Format(time.RFC3339))
+
+	payload, err := json.Marshal(serverInfo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding server info: %v\n", err)
+		os.Exit(1)
+	}
+	signature, err := signData(payload, privateKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error signing server info: %v\n", err)
+		os.Exit(1)
+	}
+
+	legacy := serverInfo.Server
+	if legacy == "" && len(serverInfo.Servers) > 0 {
+		legacy = orderServers(serverInfo.Servers)[0].URL
+	}
+	output, err := json.MarshalIndent(signedServerInfo{
+		Server:    legacy,
+		Data:      base64.StdEncoding.EncodeToString(payload),
+		Signature: signature,
+	}, "", "    ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding server info: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(output))
+}
+
+// generateDiscoveryKey writes a new discovery private key to keyPath and
+// prints the public key to build the client with.
+func generateDiscoveryKey(keyPath string) {
+	if _, err := os.Stat(keyPath); err == nil {
+		fmt.Printf("%s already exists\n", keyPath)
+		os.Exit(1)
+	}
+
+	privateKey, publicKey, err := generateECCKeyPair()
+	if err != nil {
+		fmt.Printf("Error generating key pair: %v\n", err)
+		os.Exit(1)
+	}
+	privateKeyStr, err := encodePrivateKey(privateKey)
+	if err != nil {
+		fmt.Printf("Error encoding private key: %v\n", err)
+		os.Exit(1)
+	}
+	publicKeyStr, err := encodePublicKey(publicKey)
+	if err != nil {
+		fmt.Printf("Error encoding public key: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := writeFileAtomic(keyPath, []byte(privateKeyStr+"\n"), 0600); err != nil {
+		fmt.Printf("Error writing %s: %v\n", keyPath, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Discovery private key written to %s (keep it offline)\n", keyPath)
+	fmt.Printf("Public key: %s\n", publicKeyStr)
+	fmt.Printf("Build the client with: -ldflags \"-X main.discoveryPublicKey=%s\"\n", publicKeyStr)
+}
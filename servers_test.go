@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOrderServers(t *testing.T) {
+	entries := []ServerEntry{
+		{URL: "https://c.vozdns.vn", Priority: 20},
+		{URL: "https://a.vozdns.vn", Priority: 10, Weight: 3},
+		{URL: ""},
+		{URL: "https://b.vozdns.vn", Priority: 10, Weight: 1},
+		{URL: "https://d.vozdns.vn", Priority: 30, Weight: 0},
+	}
+
+	first := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		ordered := orderServers(entries)
+		if len(ordered) != 4 {
+			t.Fatalf("got %d servers, want 4 (the entry without a url is dropped)", len(ordered))
+		}
+		if ordered[2].URL != "https://c.vozdns.vn" || ordered[3].URL != "https://d.vozdns.vn" {
+			t.Fatalf("lower priorities not tried first: %+v", ordered)
+		}
+		first[ordered[0].URL]++
+	}
+
+	// a has three times b's weight, so it should come first about 75% of
+	// the time.
+	if share := float64(first["https://a.vozdns.vn"]) / 2000; share < 0.65 || share > 0.85 {
+		t.Errorf("a came first %.0f%% of the time, want about 75%%", share*100)
+	}
+}
+
+func TestShouldFailover(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "unreachable", err: errors.New("connection refused"), want: true},
+		{name: "server error", err: &serverError{Status: 500}, want: true},
+		{name: "retryable provider error", err: &serverError{Status: 503, Retryable: true}, want: false},
+		{name: "unauthorized", err: &serverError{Status: 401}, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := shouldFailover(test.err); got != test.want {
+				t.Errorf("shouldFailover = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestServerRequestTimeoutCoversRetries(t *testing.T) {
+	// The last attempt of a SetRecord can make a lookup, an update and a
+	// duplicate delete after the retry deadline has passed.
+	worstCase := maxRetryDeadline + 3*providerRequestTimeout
+	if serverRequestTimeout <= worstCase {
+		t.Errorf("serverRequestTimeout %s does not cover the server's worst case %s", serverRequestTimeout, worstCase)
+	}
+	if got := (RetryConfig{Deadline: Duration(time.Hour)}).withDefaults().Deadline; got != Duration(maxRetryDeadline) {
+		t.Errorf("deadline = %s, want it capped at %s", time.Duration(got), maxRetryDeadline)
+	}
+}
+
+// useDiscoveryKey makes the client trust a fresh discovery key for the test.
+func useDiscoveryKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	privateKey, publicKey, err := generateECCKeyPair()
+	if err != nil {
+		t.Fatalf("generateECCKeyPair: %v", err)
+	}
+	encoded, err := encodePublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("encodePublicKey: %v", err)
+	}
+
+	previous := discoveryPublicKey
+	discoveryPublicKey = encoded
+	t.Cleanup(func() { discoveryPublicKey = previous })
+	return privateKey
+}
+
+func signedServerInfoJSON(t *testing.T, key *ecdsa.PrivateKey, serverInfo ServerInfo) []byte {
+	t.Helper()
+	payload, err := json.Marshal(serverInfo)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	signature, err := signData(payload, key)
+	if err != nil {
+		t.Fatalf("signData: %v", err)
+	}
+	body, err := json.Marshal(signedServerInfo{Data: base64.StdEncoding.EncodeToString(payload), Signature: signature})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	return body
+}
+
+func TestVerifyServerInfo(t *testing.T) {
+	key := useDiscoveryKey(t)
+	otherKey, _, err := generateECCKeyPair()
+	if err != nil {
+		t.Fatalf("generateECCKeyPair: %v", err)
+	}
+
+	now := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	valid := ServerInfo{
+		Servers: []ServerEntry{{URL: "https://a.vozdns.vn", PublicKey: "MFkw"}},
+		Version: 2,
+		Expires: now.Add(time.Hour),
+	}
+	expired := valid
+	expired.Expires = now.Add(-time.Hour)
+	noExpiry := valid
+	noExpiry.Expires = time.Time{}
+
+	tampered := signedServerInfoJSON(t, key, valid)
+	var signed signedServerInfo
+	json.Unmarshal(tampered, &signed)
+	signed.Data = base64.StdEncoding.EncodeToString([]byte(`{"servers":[{"url":"https://evil.example"}],"expires":"2030-01-01T00:00:00Z"}`))
+	tampered, _ = json.Marshal(signed)
+
+	tests := []struct {
+		name string
+		body []byte
+		ok   bool
+	}{
+		{name: "valid", body: signedServerInfoJSON(t, key, valid), ok: true},
+		{name: "unsigned", body: []byte(`{"server": "https://a.vozdns.vn"}`)},
+		{name: "wrong key", body: signedServerInfoJSON(t, otherKey, valid)},
+		{name: "tampered", body: tampered},
+		{name: "expired", body: signedServerInfoJSON(t, key, expired)},
+		{name: "no expiry", body: signedServerInfoJSON(t, key, noExpiry)},
+		{name: "not json", body: []byte("<html>")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serverInfo, err := verifyServerInfo(test.body, now)
+			if !test.ok {
+				if err == nil {
+					t.Errorf("accepted %s server info", test.name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyServerInfo: %v", err)
+			}
+			if serverInfo.Version != 2 || len(serverInfo.Servers) != 1 || serverInfo.Servers[0].URL != "https://a.vozdns.vn" {
+				t.Errorf("server info = %+v", serverInfo)
+			}
+		})
+	}
+}
+
+func TestVerifyServerInfoWithoutBuiltInKey(t *testing.T) {
+	key := useDiscoveryKey(t)
+	signed := signedServerInfoJSON(t, key, ServerInfo{Servers: []ServerEntry{{URL: "https://a.vozdns.vn"}}, Expires: time.Now().Add(time.Hour)})
+	discoveryPublicKey = ""
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "legacy server.json", body: `{"server": "https://ddns-updater.vozdns.vn"}`, want: "https://ddns-updater.vozdns.vn"},
+		{name: "signed server.json keeps the legacy field", body: `{"server": "https://legacy.vozdns.vn", "data": "x", "signature": "y"}`, want: "https://legacy.vozdns.vn"},
+		{name: "signed server.json without the legacy field", body: string(signed)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serverInfo, err := verifyServerInfo([]byte(test.body), time.Now())
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("accepted %+v without a discovery key", serverInfo)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyServerInfo: %v", err)
+			}
+			if serverInfo.Server != test.want || len(serverInfo.Servers) != 0 {
+				t.Errorf("server info = %+v, want only %s", serverInfo, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckDiscoveryVersion(t *testing.T) {
+	t.Setenv("VOZDNS_STATE_DIR", t.TempDir())
+	reset := func() {
+		discoveryVersion.loaded = false
+		discoveryVersion.seen = 0
+	}
+	reset()
+	t.Cleanup(reset)
+
+	for _, version := range []int64{5, 5, 7} {
+		if err := checkDiscoveryVersion(version); err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+	}
+	if err := checkDiscoveryVersion(6); err == nil {
+		t.Fatal("accepted an older version")
+	}
+
+	// The highest version survives a restart.
+	reset()
+	if err := checkDiscoveryVersion(6); err == nil {
+		t.Fatal("accepted an older version after a restart")
+	}
+	if err := checkDiscoveryVersion(7); err != nil {
+		t.Fatalf("version 7: %v", err)
+	}
+}
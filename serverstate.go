@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultServerStateFile = "./state.json"
+
+type registeredRecord struct {
+	Domain    string    `json:"domain"`
+	Type      string    `json:"type"`
+	Content   string    `json:"content"`
+	Proxied   bool      `json:"proxied"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// serverState remembers what each client last registered, so the server can
+// tell when the provider's records no longer match.
+type serverState struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]*registeredRecord
+}
+
+func loadServerState(path string) (*serverState, error) {
+	if path == "" {
+		path = defaultServerStateFile
+	}
+	state := &serverState{path: path, records: make(map[string]*registeredRecord)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	var records []*registeredRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+	for _, record := range records {
+		state.records[stateKey(record.Domain, record.Type)] = record
+	}
+
+	return state, nil
+}
+
+func stateKey(domain, recordType string) string {
+	return normalizeRecordName(domain) + "/" + recordType
+}
+
+func (s *serverState) setRecord(domain, recordType, content string, proxied bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[stateKey(domain, recordType)] = &registeredRecord{
+		Domain:    normalizeRecordName(domain),
+		Type:      recordType,
+		Content:   content,
+		Proxied:   proxied,
+		UpdatedAt: time.Now().UTC(),
+	}
+	return s.save()
+}
+
+func (s *serverState) removeDomain(domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	domain = normalizeRecordName(domain)
+	for key, record := range s.records {
+		if record.Domain == domain {
+			delete(s.records, key)
+		}
+	}
+	return s.save()
+}
+
+func (s *serverState) removeRecord(domain, recordType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, stateKey(domain, recordType))
+	return s.save()
+}
+
+// hasDomain reports whether the server has registered records for domain.
+func (s *serverState) hasDomain(domain string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	domain = normalizeRecordName(domain)
+	for _, record := range s.records {
+		if record.Domain == domain {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *serverState) list() []registeredRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make([]registeredRecord, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return stateKey(records[i].Domain, records[i].Type) < stateKey(records[j].Domain, records[j].Type)
+	})
+	return records
+}
+
+// save must be called with s.mu held.
+func (s *serverState) save() error {
+	records := make([]*registeredRecord, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return stateKey(records[i].Domain, records[i].Type) < stateKey(records[j].Domain, records[j].Type)
+	})
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
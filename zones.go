@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type zoneRegistry struct {
+	zones []*zoneEntry
+	retry RetryConfig
+}
+
+type zoneEntry struct {
+	config   *ZoneConfig
+	provider DNSProvider
+}
+
+// newZoneRegistry builds the zone list from the server config. Zone entries
+// inherit any setting they leave empty from the top-level config, and a config
+// without "zones" behaves as a single zone that matches every domain.
+func newZoneRegistry(config *ServerConfig) (*zoneRegistry, error) {
+	registry := &zoneRegistry{retry: config.Retry}
+
+	if len(config.Zones) == 0 {
+		zone := config.ZoneConfig
+		if err := registry.add(&zone); err != nil {
+			return nil, err
+		}
+		return registry, nil
+	}
+
+	for suffix, zoneConfig := range config.Zones {
+		if zoneConfig == nil {
+			return nil, fmt.Errorf("zone %q has no settings", suffix)
+		}
+
+		zone := *zoneConfig
+		zone.Name = strings.ToLower(strings.Trim(suffix, "."))
+		if zone.Name == "" {
+			return nil, fmt.Errorf("zone suffix must not be empty")
+		}
+		if zone.AuthType == "" && zone.AuthKey == "" {
+			zone.AuthType = config.AuthType
+			zone.AuthEmail = config.AuthEmail
+			zone.AuthKey = config.AuthKey
+		}
+		if zone.CloudflareAPI == "" {
+			zone.CloudflareAPI = config.CloudflareAPI
+		}
+		if zone.PowerDNSAPI == "" {
+			zone.PowerDNSAPI = config.PowerDNSAPI
+		}
+		if zone.PowerDNSServerID == "" {
+			zone.PowerDNSServerID = config.PowerDNSServerID
+		}
+		if zone.DuplicatePolicy == "" {
+			zone.DuplicatePolicy = config.DuplicatePolicy
+		}
+		if zone.Provider == "" {
+			zone.Provider = config.Provider
+		}
+		if zone.MirrorPolicy == "" {
+			zone.MirrorPolicy = config.MirrorPolicy
+		}
+		if err := registry.add(&zone); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(registry.zones, func(i, j int) bool {
+		return len(registry.zones[i].config.Name) > len(registry.zones[j].config.Name)
+	})
+
+	return registry, nil
+}
+
+func (r *zoneRegistry) add(zone *ZoneConfig) error {
+	var provider DNSProvider
+	var err error
+	if len(zone.Mirrors) > 0 {
+		provider, err = newMirrorProvider(zone, r.retry)
+	} else {
+		provider, err = newProvider(zone)
+	}
+	if err != nil {
+		if zone.Name != "" {
+			return fmt.Errorf("zone %s: %v", zone.Name, err)
+		}
+		return err
+	}
+
+	r.zones = append(r.zones, &zoneEntry{config: zone, provider: provider})
+	return nil
+}
+
+// verify checks every zone's provider, so bad credentials stop the server at
+// startup instead of failing the first registration.
+func (r *zoneRegistry) verify() error {
+	for _, zone := range r.zones {
+		if err := zone.provider.Verify(); err != nil {
+			if zone.config.Name != "" {
+				return fmt.Errorf("zone %s (%s): %v", zone.config.Name, zone.provider.Name(), err)
+			}
+			return fmt.Errorf("%s: %v", zone.provider.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (r *zoneRegistry) start() error {
+	for _, zone := range r.zones {
+		service, ok := zone.provider.(serviceProvider)
+		if !ok {
+			continue
+		}
+		if err := service.Start(); err != nil {
+			return fmt.Errorf("zone %s (%s): %v", zone.config.Name, zone.provider.Name(), err)
+		}
+	}
+	return nil
+}
+
+// lookup returns the provider of the zone with the longest suffix matching
+// domain.
+func (r *zoneRegistry) lookup(domain string) (DNSProvider, error) {
+	domain = normalizeRecordName(domain)
+
+	for _, zone := range r.zones {
+		name := zone.config.Name
+		if name != "" && domain != name && !strings.HasSuffix(domain, "."+name) {
+			continue
+		}
+		return zone.provider, nil
+	}
+
+	return nil, fmt.Errorf("no zone configured for %s", domain)
+}